@@ -24,6 +24,7 @@ const (
 	dontbugDefaultReplayPort            int    = 9000
 	dontbugDefaultGdbExtendedRemotePort int    = 9999
 	dontbugPhpIdeIP                     string = "127.0.0.1"
+	dontbugDefaultIdeKey                string = "dontbug"
 )
 
 var (
@@ -68,6 +69,11 @@ Basic Usage
   prompt. In reverse mode the buttons in your IDE will remain the same but they will have the reverse effect
   when you press them: e.g. Step Over will now be reverse Step Over and so forth.
 - Press h for help on dontbug prompt for more information
+- If the IDE disconnects, dontbug keeps trying to reconnect to it. The replay position and breakpoints are retained
+  so you can simply ask your IDE to listen for debugging connections again and carry on from where you were
+- Use 'dontbug replay --listen' if you would rather have your IDE connect to dontbug instead
+- If you share a debug server via a DBGp proxy, use 'dontbug replay --dbgp-proxy host:port --idekey YOURKEY'. The
+  proxy routes the session to the IDE that registered itself with the proxy using YOURKEY
 
 Tips, Gotchas
 -------------
@@ -99,6 +105,9 @@ workflow. Therefore: simply do a 'dontbug record' again if your PHP sources have
 
 		replayHost := viper.GetString("replay-host")
 		replayPort := viper.GetInt("replay-port")
+		listen := viper.GetBool("listen")
+		ideKey := viper.GetString("idekey")
+		dbgpProxy := viper.GetString("dbgp-proxy")
 		installLocation := viper.GetString("install-location")
 		targedExtendedRemotePort := viper.GetInt("gdb-remote-port")
 		rrExecutable := viper.GetString("with-rr")
@@ -119,6 +128,9 @@ workflow. Therefore: simply do a 'dontbug record' again if your PHP sources have
 			gdbPath,
 			replayHost,
 			replayPort,
+			listen,
+			ideKey,
+			dbgpProxy,
 			targedExtendedRemotePort,
 		)
 	},
@@ -129,6 +141,9 @@ func init() {
 	replayCmd.Flags().StringVar(&gPhpIdeIP, "replay-host", dontbugPhpIdeIP, "IP address of the dbgp client i.e. the PHP IDE debugger")
 	replayCmd.Flags().BoolP("gdb-notify", "g", false, "show notification messages from gdb")
 	replayCmd.Flags().Int("replay-port", dontbugDefaultReplayPort, "dbgp client port i.e. PHP IDE debugger port")
+	replayCmd.Flags().Bool("listen", false, "listen on replay-host:replay-port for the PHP IDE to connect instead of connecting to it")
+	replayCmd.Flags().String("idekey", dontbugDefaultIdeKey, "IDE key sent in the dbgp init packet (can also be set via the DBGP_IDEKEY environment variable)")
+	replayCmd.Flags().String("dbgp-proxy", "", "host:port of a DBGp proxy to connect to instead of connecting to the PHP IDE directly")
 	replayCmd.Flags().Int("gdb-remote-port", dontbugDefaultGdbExtendedRemotePort, "port at which rr backend should be made available to gdb")
 	replayCmd.Flags().StringVar(&gGdbExecutableFlag, "with-gdb", "", "the gdb (>= 7.11.1) executable (default is to assume gdb exists in $PATH)")
 }
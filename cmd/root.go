@@ -78,6 +78,9 @@ func initConfig() {
 
 	viper.BindPFlag("replay-host", replayCmd.Flags().Lookup("replay-host"))
 	viper.BindPFlag("replay-port", replayCmd.Flags().Lookup("replay-port"))
+	viper.BindPFlag("listen", replayCmd.Flags().Lookup("listen"))
+	viper.BindPFlag("idekey", replayCmd.Flags().Lookup("idekey"))
+	viper.BindPFlag("dbgp-proxy", replayCmd.Flags().Lookup("dbgp-proxy"))
 	viper.BindPFlag("gdb-notify", replayCmd.Flags().Lookup("gdb-notify"))
 	viper.BindPFlag("gdb-remote-port", replayCmd.Flags().Lookup("gdb-remote-port"))
 	viper.BindPFlag("with-gdb", replayCmd.Flags().Lookup("with-gdb"))
@@ -92,12 +95,16 @@ func initConfig() {
 	viper.SetDefault("php-cli-script", false)
 	viper.SetDefault("args", "")
 
+	// Same environment variable Xdebug uses
+	viper.BindEnv("idekey", "DBGP_IDEKEY")
+
 	viper.RegisterAlias("record_port", "record-port")
 	viper.RegisterAlias("server_port", "server-port")
 	viper.RegisterAlias("server_listen", "server-listen")
 	viper.RegisterAlias("gdb_notify", "gdb-notify")
 	viper.RegisterAlias("replay_host", "replay-host")
 	viper.RegisterAlias("replay_port", "replay-port")
+	viper.RegisterAlias("dbgp_proxy", "dbgp-proxy")
 	viper.RegisterAlias("max_stack_depth", "max-stack-depth")
 	viper.RegisterAlias("install_location", "install-location")
 	viper.RegisterAlias("gdb_remote_port", "gdb-remote-port")
@@ -16,9 +16,12 @@ package engine
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"github.com/Masterminds/semver"
+	"github.com/chzyer/readline"
 	"github.com/cyrus-and/gdb"
 	"github.com/fatih/color"
 	"log"
@@ -32,11 +35,12 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 const (
-	dontbugCstepLineNumTemp int = 91
-	dontbugCstepLineNum     int = 99
+	dontbugCstepLineNumTemp int = 100
+	dontbugCstepLineNum     int = 114
 	dontbugCpathStartsAt    int = 6
 	dontbugMasterBp             = "1"
 
@@ -50,6 +54,21 @@ const (
 	reasonError      engineReason = "error"
 	reasonAborted    engineReason = "aborted"
 	reasonExeception engineReason = "exception"
+
+	// Error codes from the dbgp spec that are not specific to breakpoints
+	dbgpErrorCodeParse          dbgpErrorCode = 1
+	dbgpErrorCodeInvalidOptions dbgpErrorCode = 3
+	dbgpErrorCodeUnimplemented  dbgpErrorCode = 4
+	dbgpErrorCodeNotAvailable   dbgpErrorCode = 5
+
+	// Sent on engineState.breakStopNotify instead of a breakpoint id when gdb stops at either end of the rr trace
+	stopIDTraceStart = "trace-start"
+	stopIDTraceEnd   = "trace-end"
+	// Sent for any other stop, usually because we asked gdb to interrupt a run
+	stopIDInterrupted = "interrupted"
+
+	// Namespace for dontbug specific attributes and elements in dbgp packets
+	dontbugXMLNamespace = "https://github.com/sidkshatriya/dontbug"
 )
 
 var (
@@ -72,15 +91,65 @@ type engineState struct {
 	sourceMap       map[string]int
 	maxStackDepth   int
 	levelAr         []int
+	stdFdModes      map[string]int // stdout/stderr -> 0 (disable), 1 (copy) or 2 (redirect)
+	stdFdBpID       string         // gdb breakpoint on write(2) used to capture stdout/stderr. "" if none
+	pendingStreams  []engineStreamChunk
+	ideWriteMutex   sync.Mutex
+	ideEncoding     string // guarded by ideWriteMutex. See setIdeEncoding()
+	// The goroutine handling IDE commands and the dontbug prompt both drive gdb. See acquireEngine()
+	engineLock chan struct{}
+
+	requestNum        int          // value of dontbug_request_num in PHP at the last stop
+	statusBeforeStop  engineStatus // so that a new IDE connection knows if we were at the end of the trace
+	ideKey            string
+	gdbConsole        *gdbConsoleCapture
+	lastHitBreakpoint *engineBreakPoint // PHP breakpoint that caused the last stop, nil if none
+
+	// A break from the IDE or Ctrl-C on the prompt arrives on a goroutine of its own while a run/step is in
+	// progress. runMutex guards the fields below, which is all such a goroutine may look at. See beginRun()
+	runMutex   sync.Mutex
+	runDepth   int  // > 0 while a run/step is in progress
+	gdbRunning bool // gdb has been sent exec-continue and has not stopped yet
+	// Set when the user (or IDE) has asked for a run/step in progress to be interrupted
+	interruptRequested bool
+	// run/step commands the IDE has sent that have not been dispatched yet. See queueRun()
+	queuedRuns int
+
+	// PHP filename -> the gdb breakpoint shared by the line breakpoints of the file
+	fileBreakpoints map[string]*engineFileBreakpoint
+	// Line in dontbug_break.c used for breakpoints in PHP files that are not in sourceMap. 0 if there is none
+	fallbackBreakLine int
+	// Number of PHP breakpoints set so far. See nextPhpBreakpointID()
+	breakpointCount int
+	// PHP filename -> sorted line numbers on which PHP statements start. See nearestExecutableLine()
+	executableLines map[string][]int
+
+	// rr position of the PHP statement we last settled on. Shown in the dontbug prompt
+	rrPosition rrPosition
+	prompt     *readline.Instance
+	// The dontbug prompt sends on this to connect to the IDE again after the IDE stopped the debugging session
+	reconnectIde chan struct{}
+	// Ids of the breakpoints that were there before the IDE connected. See notifyPreexistingBreakpointsToIde()
+	preexistingBreakpoints []string
+	// Bookmark name -> bookmark. Like breakpoints, these remain when the IDE reconnects
+	// Only to be used with the engine in hand (see acquireEngine()) as the prompt has bookmarks too
+	bookmarks map[string]*engineBookmark
+
+	// The session is saved in the rr trace directory. traceDir is "" if the session is not to be saved
+	traceDir     string
+	session      engineSession
+	sessionMutex sync.Mutex
 }
 
 type engineStatus string
 type engineReason string
+type dbgpErrorCode int
 
 type dbgpCmd struct {
 	command     string            // only the command name eg. stack_get
 	fullCommand string            // full command string e.g. "stack_get -i ..."
 	options     map[string]string // just the options after the command name
+	data        string            // the base64 decoded data after "--" if any
 	seqNum      int
 	reverse     bool // Run this command in reverse. Does not make sense for all commands
 }
@@ -126,43 +195,162 @@ func parseGdbStringResponse(gdbResponse string) (string, error) {
 	return unquote, nil
 }
 
+// gdb prints C strings with C style escapes e.g. \" \\ \n and octal escapes like \303\251 for non-ASCII bytes
 func unquoteGdbStringResult(input string) string {
 	l := len(input)
 	var buf bytes.Buffer
-	skip := false
-	for i, c := range input {
-		if skip {
-			skip = false
+	for i := 0; i < l; i++ {
+		c := input[i]
+		if c != '\\' || i+1 >= l {
+			buf.WriteByte(c)
 			continue
 		}
 
-		if c == '\\' && i < l && input[i+1] == '"' {
-			buf.WriteRune('"')
-			skip = true
-		} else {
-			buf.WriteRune(c)
+		i++
+		switch input[i] {
+		case 'n':
+			buf.WriteByte('\n')
+		case 't':
+			buf.WriteByte('\t')
+		case 'r':
+			buf.WriteByte('\r')
+		case 'a':
+			buf.WriteByte('\a')
+		case 'b':
+			buf.WriteByte('\b')
+		case 'f':
+			buf.WriteByte('\f')
+		case 'v':
+			buf.WriteByte('\v')
+		case 'e':
+			buf.WriteByte(0x1b)
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			// Up to 3 octal digits
+			value := 0
+			j := i
+			for ; j < l && j < i+3 && input[j] >= '0' && input[j] <= '7'; j++ {
+				value = value*8 + int(input[j]-'0')
+			}
+			buf.WriteByte(byte(value))
+			i = j - 1
+		default:
+			// \" \\ \' and anything else we don't know about
+			buf.WriteByte(input[i])
 		}
 	}
 
 	return buf.String()
 }
 
-func parseCommand(fullCommand string, reverseMode bool) dbgpCmd {
-	components := strings.Fields(fullCommand)
-	flags := make(map[string]string)
-	command := components[0]
-	for i, v := range components[1:] {
-		if i%2 == 1 {
+// Splits a dbgp command into the command name, its options and the (base64 decoded) data section
+//
+// The dbgp grammar is: command [SPACE] [args] -- data
+// Each argument is of the form -x value. A value may be enclosed in double quotes, in which case
+// any character preceded by a backslash (usually \" or \\) is taken literally
+func tokenizeDbgpCommand(fullCommand string) (string, map[string]string, string, error) {
+	options := make(map[string]string)
+	input := strings.TrimRight(fullCommand, " \t\r\n\x00")
+	l := len(input)
+
+	i := 0
+	for i < l && input[i] != ' ' {
+		i++
+	}
+
+	command := input[:i]
+	if command == "" {
+		return "", options, "", errors.New("Empty dbgp command")
+	}
+
+	for {
+		for i < l && input[i] == ' ' {
+			i++
+		}
+
+		if i == l {
+			return command, options, "", nil
+		}
+
+		if input[i] != '-' {
+			return command, options, "", fmt.Errorf("Expected an option starting with '-' at position %v", i)
+		}
+
+		// The data section is always last
+		if i+1 < l && input[i+1] == '-' && (i+2 == l || input[i+2] == ' ') {
+			encoded := strings.TrimSpace(input[i+2:])
+			data, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return command, options, "", fmt.Errorf("Data after -- is not valid base64: %v", err)
+			}
+
+			return command, options, string(data), nil
+		}
+
+		start := i + 1
+		for i < l && input[i] != ' ' {
+			i++
+		}
+
+		name := input[start:i]
+		if name == "" {
+			return command, options, "", fmt.Errorf("Empty option name at position %v", start-1)
+		}
+
+		_, ok := options[name]
+		if ok {
+			return command, options, "", fmt.Errorf("Duplicate option -%v", name)
+		}
+
+		for i < l && input[i] == ' ' {
+			i++
+		}
+
+		// We're relaxed about an option without a value at the end of the command
+		if i == l {
+			options[name] = ""
+			return command, options, "", nil
+		}
+
+		if input[i] != '"' {
+			start = i
+			for i < l && input[i] != ' ' {
+				i++
+			}
+			options[name] = input[start:i]
 			continue
 		}
 
-		// Also remove the leading "-" in the flag via [1:]
-		if i+2 < len(components) {
-			flags[strings.TrimSpace(v)[1:]] = strings.TrimSpace(components[i+2])
-		} else {
-			flags[strings.TrimSpace(v)[1:]] = ""
+		var buf bytes.Buffer
+		closed := false
+		for i++; i < l; i++ {
+			if input[i] == '\\' && i+1 < l {
+				i++
+				buf.WriteByte(input[i])
+			} else if input[i] == '"' {
+				closed = true
+				i++
+				break
+			} else {
+				buf.WriteByte(input[i])
+			}
+		}
+
+		if !closed {
+			return command, options, "", fmt.Errorf("Unterminated quoted value for option -%v", name)
+		}
+
+		if i < l && input[i] != ' ' {
+			return command, options, "", fmt.Errorf("Expected a space after the quoted value for option -%v", name)
 		}
+
+		options[name] = buf.String()
 	}
+}
+
+// Any error returned is a parse error. Even then, the dbgpCmd is filled up as much as possible
+// so that an error response can be sent back to the IDE
+func parseCommand(fullCommand string, reverseMode bool) (dbgpCmd, error) {
+	command, flags, data, parseErr := tokenizeDbgpCommand(fullCommand)
 
 	// We're going to be relaxed about missing sequence numbers here.
 	// If there is no sequence number we assume its 0
@@ -173,7 +361,9 @@ func parseCommand(fullCommand string, reverseMode bool) dbgpCmd {
 	} else {
 		var err error
 		seqInt, err = strconv.Atoi(seq)
-		panicIf(err)
+		if err != nil && parseErr == nil {
+			parseErr = fmt.Errorf("Invalid transaction id (-i) '%v'", seq)
+		}
 	}
 
 	// This flag is currently not used and should be an inexpensive way for implementations to add reversing
@@ -195,9 +385,15 @@ func parseCommand(fullCommand string, reverseMode bool) dbgpCmd {
 		command:     command,
 		fullCommand: fullCommand,
 		options:     flags,
+		data:        data,
 		seqNum:      seqInt,
 		reverse:     reverseMode,
-	}
+	}, parseErr
+}
+
+// Escapes a string so that it can be placed inside a double quoted C string literal in a gdb expression
+func gdbCStringEscape(input string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(input)
 }
 
 func xSlashSgdb(gdbSession *gdb.Gdb, expression string) string {
@@ -214,6 +410,59 @@ func xSlashDgdb(gdbSession *gdb.Gdb, expression string) int {
 	return intResult
 }
 
+// gdb/mi sends the output of console commands as "console" stream records and not in the result record
+type gdbConsoleCapture struct {
+	mutex     sync.Mutex
+	capturing bool
+	output    bytes.Buffer
+}
+
+// Returns true if the notification was console output that we captured
+func (console *gdbConsoleCapture) capture(notification map[string]interface{}) bool {
+	console.mutex.Lock()
+	defer console.mutex.Unlock()
+
+	if !console.capturing || notification["type"] != "console" {
+		return false
+	}
+
+	payload, ok := notification["payload"].(string)
+	if ok {
+		console.output.WriteString(payload)
+	}
+
+	return true
+}
+
+func (console *gdbConsoleCapture) start() {
+	console.mutex.Lock()
+	defer console.mutex.Unlock()
+
+	console.output.Reset()
+	console.capturing = true
+}
+
+func (console *gdbConsoleCapture) stop() string {
+	console.mutex.Lock()
+	defer console.mutex.Unlock()
+
+	console.capturing = false
+	return console.output.String()
+}
+
+// Runs a gdb console (i.e. non gdb/mi) command e.g. the rr specific "when-ticks" and returns its output
+func xGdbConsoleCmd(es *engineState, command string) string {
+	es.gdbConsole.start()
+	result := sendGdbCommand(es.gdbSession, "interpreter-exec", "console", fmt.Sprintf("\"%v\"", gdbCStringEscape(command)))
+	output := es.gdbConsole.stop()
+
+	if result["class"] != "done" {
+		panicWith("Could not execute gdb console command: " + command)
+	}
+
+	return output
+}
+
 func xGdbCmdValue(gdbSession *gdb.Gdb, expression string) string {
 	result := sendGdbCommand(gdbSession, "data-evaluate-expression", expression)
 	class, ok := result["class"]
@@ -234,39 +483,273 @@ func xGdbCmdValue(gdbSession *gdb.Gdb, expression string) string {
 }
 
 // Returns breakpoint id, true if stopped on a PHP breakpoint
+// Returns stopIDTraceStart or stopIDTraceEnd, false if we ran into the start or end of the rr trace instead
+// Returns stopIDInterrupted, false if the run was interrupted via interruptExecution()
 func continueExecution(es *engineState, reverse bool) (string, bool) {
 	es.status = statusRunning
-	if reverse {
-		sendGdbCommand(es.gdbSession, "exec-continue", "--reverse")
-	} else {
-		sendGdbCommand(es.gdbSession, "exec-continue")
+	beginRun(es)
+	defer endRun(es)
+
+	var breakID string
+	for {
+		if !resumeUnlessInterrupted(es, reverse) {
+			breakID = stopIDInterrupted
+			break
+		}
+
+		// Wait for the corresponding breakpoint hit break id
+		breakID = <-es.breakStopNotify
+		gdbStopped(es)
+		if breakID == stopIDInterrupted && !takeInterruptRequest(es) {
+			// Nobody asked for this stop. Probably a signal that was delivered to PHP during the recording
+			continue
+		}
+
+		if es.stdFdBpID != "" && breakID == es.stdFdBpID {
+			// Just a write to stdout/stderr. Note it and keep going
+			captureStdFdWrite(es, reverse)
+			continue
+		}
+
+		phpBreakID, skip := phpBreakpointForGdbStop(es, breakID)
+		if skip {
+			continue
+		}
+
+		breakID = phpBreakID
+
+		break
+	}
+	if breakID == stopIDTraceEnd {
+		color.Yellow("dontbug: Reached the end of the trace. Run or step in reverse mode to go back")
+		es.lastHitBreakpoint = nil
+		es.status = statusStopping
+		return breakID, false
+	}
+
+	if breakID == stopIDTraceStart {
+		color.Yellow("dontbug: Reached the start of the trace")
 	}
 
-	// Wait for the corresponding breakpoint hit break id
-	breakID := <-es.breakStopNotify
 	es.status = statusBreak
 
 	// Probably not a good idea to pass out breakId for a breakpoint that is gone
 	// But we're not using breakId currently
+	// Hit counts have already been taken care of in shouldSkipBreakpointHit()
 	if isEnabledPhpTemporaryBreakpoint(es, breakID) {
+		es.lastHitBreakpoint = es.breakpoints[breakID]
 		delete(es.breakpoints, breakID)
+
+		// gdb deletes temporary call/return/exception breakpoints itself. There is no such thing as a temporary
+		// watchpoint and line breakpoints share a gdb breakpoint with the other line breakpoints of their file
+		if es.lastHitBreakpoint.bpType == breakpointTypeWatch {
+			unresolveWatchBreakpoint(es, es.lastHitBreakpoint)
+		} else if isLineBreakpoint(es.lastHitBreakpoint) {
+			syncFileGdbBreakpoint(es, es.lastHitBreakpoint.filename)
+		}
 		return breakID, true
 	}
 
 	if isEnabledPhpBreakpoint(es, breakID) {
+		es.lastHitBreakpoint = es.breakpoints[breakID]
 		return breakID, true
 	}
 
+	es.lastHitBreakpoint = nil
 	return breakID, false
 }
 
-func constructDbgpPacket(payload string) []byte {
-	headerXML := "<?xml version=\"1.0\" encoding=\"iso-8859-1\"?>\n"
+// Escapes a string so that it can be placed inside a double quoted xml attribute
+func xmlAttrEscape(value string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(value))
+	return buf.String()
+}
+
+// Marks a run/step as in progress so that it can be interrupted. Calls nest: a navigation that is made up of
+// many continueExecution() calls is one run from start to finish
+func beginRun(es *engineState) {
+	es.runMutex.Lock()
+	defer es.runMutex.Unlock()
+
+	if es.runDepth == 0 {
+		es.interruptRequested = false
+	}
+	es.runDepth++
+}
+
+func endRun(es *engineState) {
+	es.runMutex.Lock()
+	defer es.runMutex.Unlock()
+
+	es.runDepth--
+	if es.runDepth == 0 {
+		es.interruptRequested = false
+	}
+}
+
+// The IDE may send a break right after a run/step, while the run/step is still waiting to be dispatched
+// A run/step is counted from the moment it is read so that such a break is not lost. See beginQueuedRun()
+func queueRun(es *engineState) {
+	es.runMutex.Lock()
+	defer es.runMutex.Unlock()
+	es.queuedRuns++
+}
+
+// Like beginRun() but for a run/step counted by queueRun(). A break that arrived while it was queued is kept
+func beginQueuedRun(es *engineState) {
+	es.runMutex.Lock()
+	defer es.runMutex.Unlock()
+
+	es.queuedRuns--
+	es.runDepth++
+}
+
+// The queued runs of an IDE that has gone away are never dispatched
+func clearQueuedRuns(es *engineState) {
+	es.runMutex.Lock()
+	defer es.runMutex.Unlock()
+
+	es.queuedRuns = 0
+	if es.runDepth == 0 {
+		es.interruptRequested = false
+	}
+}
+
+// Safe to call from any goroutine
+func isRunning(es *engineState) bool {
+	es.runMutex.Lock()
+	defer es.runMutex.Unlock()
+	return es.runDepth > 0
+}
+
+// exec-continue is sent under runMutex. So an interrupt either arrives before it, in which case we don't
+// resume at all, or after it, in which case exec-interrupt reaches a gdb that is actually running
+// Returns false (and consumes the interrupt) if we were interrupted
+func resumeUnlessInterrupted(es *engineState, reverse bool) bool {
+	es.runMutex.Lock()
+	defer es.runMutex.Unlock()
+
+	if es.interruptRequested {
+		es.interruptRequested = false
+		return false
+	}
+
+	if reverse {
+		sendGdbCommand(es.gdbSession, "exec-continue", "--reverse")
+	} else {
+		sendGdbCommand(es.gdbSession, "exec-continue")
+	}
+	es.gdbRunning = true
+	return true
+}
+
+func gdbStopped(es *engineState) {
+	es.runMutex.Lock()
+	defer es.runMutex.Unlock()
+	es.gdbRunning = false
+}
+
+// Returns true (and consumes the interrupt) if an interrupt had been asked for. If we stopped for some other
+// reason first, the interrupt is left pending and resumeUnlessInterrupted() will pick it up instead
+func takeInterruptRequest(es *engineState) bool {
+	es.runMutex.Lock()
+	defer es.runMutex.Unlock()
+
+	interrupted := es.interruptRequested
+	es.interruptRequested = false
+	return interrupted
+}
+
+// For a run nested in another (see beginRun()) that has stopped because of an interrupt and taken it. The interrupt
+// is asked for again so that the run it is part of stops too. Nothing is sent to gdb
+func requestInterrupt(es *engineState) {
+	es.runMutex.Lock()
+	defer es.runMutex.Unlock()
+
+	if es.runDepth > 0 {
+		es.interruptRequested = true
+	}
+}
+
+// Asks gdb to stop a run that is in progress. continueExecution() will then return stopIDInterrupted
+// A queued run (see queueRun()) stops as soon as it starts
+// Returns false if there is nothing running or queued at the moment. Safe to call from any goroutine
+func interruptExecution(es *engineState) bool {
+	es.runMutex.Lock()
+	defer es.runMutex.Unlock()
+
+	if es.runDepth == 0 && es.queuedRuns == 0 {
+		return false
+	}
+
+	es.interruptRequested = true
+	if es.gdbRunning {
+		sendGdbCommand(es.gdbSession, "exec-interrupt")
+	}
+	return true
+}
+
+// Whoever drives gdb (or reads/writes the engine state that goes with it) must have the engine first
+// engineLock is a channel with room for a single value: whoever has put one in it has the engine
+func acquireEngine(es *engineState) {
+	es.engineLock <- struct{}{}
+}
+
+// Like acquireEngine() but returns false straight away if someone else has the engine
+func tryAcquireEngine(es *engineState) bool {
+	select {
+	case es.engineLock <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseEngine(es *engineState) {
+	<-es.engineLock
+}
+
+func withEngine(es *engineState, f func()) {
+	acquireEngine(es)
+	defer releaseEngine(es)
+	f()
+}
+
+// Runs f on behalf of the dontbug prompt. f is run in a goroutine of its own so that the prompt can still take a
+// Ctrl-C: if run is true, f moves about the trace and counts as a run (see beginRun()) from start to finish
+// Nothing is run if the IDE (or an earlier prompt command) has the engine at the moment
+func runFromPrompt(es *engineState, run bool, f func()) {
+	if !tryAcquireEngine(es) {
+		color.Yellow("dontbug: Please wait for the current run/step to complete")
+		return
+	}
+
+	if run {
+		beginRun(es)
+	}
+
+	go func() {
+		defer releaseEngine(es)
+		if run {
+			defer endRun(es)
+		}
+		f()
+		if es.prompt != nil {
+			es.prompt.Refresh()
+		}
+	}()
+}
+
+// payload is expected to be UTF-8. It is transcoded to encoding, which should match what the IDE negotiated
+func constructDbgpPacket(payload string, encoding string) []byte {
+	headerXML := fmt.Sprintf("<?xml version=\"1.0\" encoding=\"%v\"?>\n", strings.ToLower(encoding))
+	encodedPayload := fromUTF8(payload, encoding)
 	var buf bytes.Buffer
-	buf.WriteString(strconv.Itoa(len(payload) + len(headerXML)))
+	buf.WriteString(strconv.Itoa(len(encodedPayload) + len(headerXML)))
 	buf.Write([]byte{0})
 	buf.WriteString(headerXML)
-	buf.WriteString(payload)
+	buf.Write(encodedPayload)
 	buf.Write([]byte{0})
 	return buf.Bytes()
 }
@@ -0,0 +1,123 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenizeDbgpCommand(t *testing.T) {
+	tests := []struct {
+		input   string
+		command string
+		options map[string]string
+		data    string
+		isErr   bool
+	}{
+		{"status -i 1", "status", map[string]string{"i": "1"}, "", false},
+		{"run -i 12\x00", "run", map[string]string{"i": "12"}, "", false},
+		{"stack_get  -i 3   -d 0 ", "stack_get", map[string]string{"i": "3", "d": "0"}, "", false},
+		{"breakpoint_set -i 4 -t line -f file:///a%20b.php -n 10", "breakpoint_set",
+			map[string]string{"i": "4", "t": "line", "f": "file:///a%20b.php", "n": "10"}, "", false},
+		{`property_get -i 5 -n "$a[\"b c\"]" -d 0`, "property_get",
+			map[string]string{"i": "5", "n": `$a["b c"]`, "d": "0"}, "", false},
+		{`property_get -i 6 -n "C:\\dir"`, "property_get", map[string]string{"i": "6", "n": `C:\dir`}, "", false},
+		{`property_get -i 7 -n ""`, "property_get", map[string]string{"i": "7", "n": ""}, "", false},
+		{"eval -i 8 -- JGEgKyAx", "eval", map[string]string{"i": "8"}, "$a + 1", false},
+		{"eval -i 9 --", "eval", map[string]string{"i": "9"}, "", false},
+		{"breakpoint_set -i 10 -t conditional -- JGEgPT0gLTE=", "breakpoint_set",
+			map[string]string{"i": "10", "t": "conditional"}, "$a == -1", false},
+		{"feature_get -i 11 -n", "feature_get", map[string]string{"i": "11", "n": ""}, "", false},
+
+		{"", "", map[string]string{}, "", true},
+		{"  \x00", "", map[string]string{}, "", true},
+		{"run i 1", "run", map[string]string{}, "", true},
+		{"run -i 1 -i 2", "run", map[string]string{"i": "1"}, "", true},
+		{"run - 1", "run", map[string]string{}, "", true},
+		{`property_get -i 1 -n "$a`, "property_get", map[string]string{"i": "1"}, "", true},
+		{`property_get -i 1 -n "$a"b`, "property_get", map[string]string{"i": "1"}, "", true},
+		{"eval -i 1 -- not*base64", "eval", map[string]string{"i": "1"}, "", true},
+	}
+
+	for _, test := range tests {
+		command, options, data, err := tokenizeDbgpCommand(test.input)
+		if (err != nil) != test.isErr {
+			t.Errorf("tokenizeDbgpCommand(%q): expected error %v, got %v", test.input, test.isErr, err)
+			continue
+		}
+
+		if command != test.command || !reflect.DeepEqual(options, test.options) || data != test.data {
+			t.Errorf("tokenizeDbgpCommand(%q): expected %q %v %q, got %q %v %q", test.input,
+				test.command, test.options, test.data, command, options, data)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		input       string
+		reverseMode bool
+		command     string
+		seqNum      int
+		reverse     bool
+		isErr       bool
+	}{
+		{"run -i 12", false, "run", 12, false, false},
+		{"run -i 12", true, "run", 12, true, false},
+		{"step_into -i 3 -z 1", false, "step_into", 3, true, false},
+		{"step_into -i 3 -z 0", true, "step_into", 3, false, false},
+		{"step_into -i 3 -z 2", true, "step_into", 3, true, false},
+		{"status", false, "status", 0, false, false},
+		{"status -i abc", false, "status", 0, false, true},
+		{"status -i 1 -i 2", false, "status", 1, false, true},
+	}
+
+	for _, test := range tests {
+		dCmd, err := parseCommand(test.input, test.reverseMode)
+		if (err != nil) != test.isErr {
+			t.Errorf("parseCommand(%q): expected error %v, got %v", test.input, test.isErr, err)
+			continue
+		}
+
+		if dCmd.command != test.command || dCmd.seqNum != test.seqNum || dCmd.reverse != test.reverse || dCmd.fullCommand != test.input {
+			t.Errorf("parseCommand(%q, %v): expected %v seq %v reverse %v, got %v seq %v reverse %v", test.input,
+				test.reverseMode, test.command, test.seqNum, test.reverse, dCmd.command, dCmd.seqNum, dCmd.reverse)
+		}
+	}
+}
+
+func TestInterruptQueuedRun(t *testing.T) {
+	es := &engineState{}
+	if interruptExecution(es) {
+		t.Error("Expected a break with nothing running or queued to be refused")
+	}
+
+	// A break that arrives after run has been read but before it is dispatched
+	queueRun(es)
+	if !interruptExecution(es) {
+		t.Fatal("Expected a break for a queued run to be accepted")
+	}
+
+	beginQueuedRun(es)
+	if resumeUnlessInterrupted(es, false) {
+		t.Error("Expected the queued run to stop as soon as it starts")
+	}
+	endRun(es)
+
+	if isRunning(es) || es.interruptRequested {
+		t.Error("Expected nothing to be running or pending once the run is over")
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	bookmarkActionMark = "mark"
+	bookmarkActionGoto = "goto"
+	bookmarkActionList = "list"
+)
+
+// A bookmark is an rr checkpoint taken at a PHP statement. rr can restart from a checkpoint straight away
+// instead of having to run there (in either direction)
+type engineBookmark struct {
+	name       string
+	checkpoint string // rr checkpoint number
+	filename   string
+	lineno     int
+	position   rrPosition
+}
+
+type bookmarksByPosition []*engineBookmark
+
+func (b bookmarksByPosition) Len() int           { return len(b) }
+func (b bookmarksByPosition) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b bookmarksByPosition) Less(i, j int) bool { return b[i].position.ticks < b[j].position.ticks }
+
+// Looks like: Checkpoint 1 at event 1234
+var gRRCheckpointRegexp = regexp.MustCompile(`Checkpoint (\d+)`)
+
+func init() {
+	registerDbgpCmdHandler("dontbug_bookmark", handleDontbugBookmark)
+}
+
+// dontbug_bookmark -a mark -n <name>, dontbug_bookmark -a goto -n <name> or dontbug_bookmark -a list
+// mark and list respond with the bookmark(s). goto responds like run/step do
+func handleDontbugBookmark(es *engineState, dCmd dbgpCmd) string {
+	action := dCmd.options["a"]
+	name := dCmd.options["n"]
+
+	switch action {
+	case bookmarkActionMark:
+		bookmark, err := markBookmark(es, name)
+		if err != nil {
+			return fmt.Sprintf(gErrorXMLResponseFormat, "dontbug_bookmark", dCmd.seqNum, dbgpErrorCodeInvalidOptions, xmlAttrEscape(err.Error()))
+		}
+		return fmt.Sprintf(gDontbugBookmarkXMLResponseFormat, dontbugXMLNamespace, dCmd.seqNum, bookmarkXML(bookmark))
+	case bookmarkActionGoto:
+		err := gotoBookmark(es, name)
+		if err != nil {
+			return fmt.Sprintf(gErrorXMLResponseFormat, "dontbug_bookmark", dCmd.seqNum, dbgpErrorCodeInvalidOptions, xmlAttrEscape(err.Error()))
+		}
+		return phpBreakResponse(es, "dontbug_bookmark", dCmd.seqNum)
+	case bookmarkActionList:
+		var buf bytes.Buffer
+		for _, bookmark := range sortedBookmarks(es) {
+			buf.WriteString(bookmarkXML(bookmark))
+		}
+		return fmt.Sprintf(gDontbugBookmarkXMLResponseFormat, dontbugXMLNamespace, dCmd.seqNum, buf.String())
+	default:
+		return fmt.Sprintf(gErrorXMLResponseFormat, "dontbug_bookmark", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Please provide the action option -a as one of mark, goto or list")
+	}
+}
+
+// Creates an rr checkpoint at the PHP statement we're at. An existing bookmark of the same name is replaced
+func markBookmark(es *engineState, name string) (*engineBookmark, error) {
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return nil, errors.New("Please provide a bookmark name without any spaces")
+	}
+
+	if es.status == statusStopping {
+		return nil, errors.New("Cannot bookmark the end of the trace. Run or step in reverse mode to go back")
+	}
+
+	// At these, we're somewhere in the middle of a PHP statement. Restarting there would confuse us
+	if stayAtBreakpointHit(es) {
+		return nil, errors.New("Please step to a PHP statement before bookmarking")
+	}
+
+	checkpoint, err := createRRCheckpoint(es)
+	if err != nil {
+		return nil, err
+	}
+
+	old, ok := es.bookmarks[name]
+	if ok {
+		deleteRRCheckpoint(es, old.checkpoint)
+	}
+
+	filename, phpLineno := phpFilenameAndLineno(es)
+	bookmark := &engineBookmark{
+		name:       name,
+		checkpoint: checkpoint,
+		filename:   filename,
+		lineno:     phpLineno,
+		position:   rrPosition{currentRREvent(es), currentRRTicks(es)},
+	}
+
+	es.bookmarks[name] = bookmark
+	return bookmark, nil
+}
+
+// rr restarts from the checkpoint of the bookmark. This is just like gotoRREvent() except that we're already
+// at a PHP statement once rr gets there
+func gotoBookmark(es *engineState, name string) error {
+	bookmark, ok := es.bookmarks[name]
+	if !ok {
+		return errors.New("No such bookmark: " + name)
+	}
+
+	if !restartFromRRCheckpoint(es, bookmark.checkpoint) {
+		return fmt.Errorf("Could not restart from the rr checkpoint of bookmark %v", name)
+	}
+
+	es.status = statusBreak
+	es.lastHitBreakpoint = nil
+	return nil
+}
+
+// Returns the rr checkpoint number
+func createRRCheckpoint(es *engineState) (string, error) {
+	output := xGdbConsoleCmd(es, "checkpoint")
+	matches := gRRCheckpointRegexp.FindStringSubmatch(output)
+	if matches == nil {
+		return "", errors.New("rr did not create a checkpoint: " + strings.TrimSpace(output))
+	}
+
+	return matches[1], nil
+}
+
+// Returns false if rr could not restart from the checkpoint, in which case we stay where we were
+func restartFromRRCheckpoint(es *engineState, checkpoint string) bool {
+	sendGdbCommand(es.gdbSession, "gdb-set", "confirm", "off")
+	result := sendGdbCommand(es.gdbSession, "interpreter-exec", "console", fmt.Sprintf("\"restart %v\"", checkpoint))
+	if result["class"] == "error" {
+		return false
+	}
+
+	// The stop at the checkpoint itself
+	<-es.breakStopNotify
+	return true
+}
+
+func deleteRRCheckpoint(es *engineState, checkpoint string) {
+	result := sendGdbCommand(es.gdbSession, "interpreter-exec", "console", fmt.Sprintf("\"delete checkpoint %v\"", checkpoint))
+	if result["class"] == "error" {
+		color.Yellow("dontbug: Could not delete rr checkpoint %v", checkpoint)
+	}
+}
+
+// In the order they occur in the trace
+func sortedBookmarks(es *engineState) []*engineBookmark {
+	var bookmarks []*engineBookmark
+	for _, bookmark := range es.bookmarks {
+		bookmarks = append(bookmarks, bookmark)
+	}
+	sort.Sort(bookmarksByPosition(bookmarks))
+
+	return bookmarks
+}
+
+func bookmarkXML(bookmark *engineBookmark) string {
+	return fmt.Sprintf(gDontbugBookmarkXMLFormat, xmlAttrEscape(bookmark.name), xmlAttrEscape(bookmark.filename),
+		bookmark.lineno, bookmark.position.event, bookmark.position.ticks)
+}
+
+// mark <name>, goto <name> and marks on the dontbug prompt
+func handleBookmarkPromptCmd(es *engineState, action string, name string) {
+	name = strings.TrimSpace(name)
+	runFromPrompt(es, action == bookmarkActionGoto, func() {
+		switch action {
+		case bookmarkActionMark:
+			bookmark, err := markBookmark(es, name)
+			if err != nil {
+				color.Red("dontbug: %v", err)
+				return
+			}
+			color.Green("dontbug: Bookmarked %v:%v as %v", bookmark.filename, bookmark.lineno, bookmark.name)
+		case bookmarkActionGoto:
+			err := gotoBookmark(es, name)
+			if err != nil {
+				color.Red("dontbug: %v", err)
+				return
+			}
+
+			notifyIfRequestChanged(es)
+			resolvePendingWatchBreakpoints(es)
+			recordRRPosition(es)
+			updateSessionFromEngineState(es)
+
+			filename, phpLineno := phpFilenameAndLineno(es)
+			color.Green("dontbug: Now at %v:%v (%v)", filename, phpLineno, es.rrPosition)
+			color.Yellow("dontbug: Your IDE will show the new position after your next step or run")
+		case bookmarkActionList:
+			bookmarks := sortedBookmarks(es)
+			if len(bookmarks) == 0 {
+				color.Yellow("dontbug: No bookmarks yet. Use mark <name> to add one")
+				return
+			}
+
+			for _, bookmark := range bookmarks {
+				fmt.Printf("%-16v %v:%v (%v)\n", bookmark.name, bookmark.filename, bookmark.lineno, bookmark.position)
+			}
+		}
+	})
+}
@@ -15,10 +15,12 @@
 package engine
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/fatih/color"
 	"log"
+	"sort"
 	"strconv"
 )
 
@@ -47,8 +49,17 @@ const (
 	// Error codes returned when a user (php) breakpoint cannot be set
 	breakpointErrorCodeCouldNotSet      engineBreakpointErrorCode = 200
 	breakpointErrorCodeTypeNotSupported engineBreakpointErrorCode = 201
+	breakpointErrorCodeNoSuchBreakpoint engineBreakpointErrorCode = 205
 )
 
+func init() {
+	registerDbgpCmdHandler("breakpoint_set", handleBreakpointSet)
+	registerDbgpCmdHandler("breakpoint_remove", handleBreakpointRemove)
+	registerDbgpCmdHandler("breakpoint_update", handleBreakpointUpdate)
+	registerDbgpCmdHandler("breakpoint_get", handleBreakpointGet)
+	registerDbgpCmdHandler("breakpoint_list", handleBreakpointList)
+}
+
 type engineBreakpointError struct {
 	code    engineBreakpointErrorCode
 	message string
@@ -66,11 +77,48 @@ type engineBreakPoint struct {
 	lineno       int
 	state        engineBreakpointState
 	temporary    bool
-	hitCount     int
+	hitCount     int // hits at or before the current position in the trace. See hitConditionHoldsAt()
 	hitValue     int
 	hitCondition engineBreakpointCondition
+	hitTicks     []int64 // sorted rr ticks of every hit in the trace, once hitsCounted. See countBreakpointHitsInTrace()
+	hitsCounted  bool
+	function     string // function or Class::method for call breakpoints
 	exception    string
 	expression   string
+
+	// The hook function in dontbug.c and the gdb breakpoint condition on it for call/return/exception breakpoints
+	hookFunction  string
+	hookCondition string
+
+	// The gdb breakpoint currently behind a call/return/exception/watch breakpoint. See phpBreakpointIDForGdbID()
+	// "" for a watch breakpoint whose variable is not resolved at the moment. Always "" for line breakpoints as
+	// they share a gdb breakpoint with the other line breakpoints of the same file. See engineFileBreakpoint
+	gdbID string
+
+	// For watch breakpoints: the PHP stack frame (and its function) the variable was resolved in
+	watchFrame    string
+	watchFunction string
+
+	// Set up without the IDE (restored from a saved session or from the dontbug prompt) and not asked for by the
+	// IDE (yet). Such breakpoints remain when a new IDE connects. See setUnclaimedBreakpoints()
+	unclaimed bool
+}
+
+type breakpointsByID []*engineBreakPoint
+
+func (arr breakpointsByID) Len() int {
+	return len(arr)
+}
+
+// gdb breakpoint numbers are always numeric so compare them as numbers
+func (arr breakpointsByID) Less(i, j int) bool {
+	a, _ := strconv.Atoi(arr[i].id)
+	b, _ := strconv.Atoi(arr[j].id)
+	return a < b
+}
+
+func (arr breakpointsByID) Swap(i, j int) {
+	arr[j], arr[i] = arr[i], arr[j]
 }
 
 func stringToBreakpointType(t string) (engineBreakpointType, error) {
@@ -93,7 +141,6 @@ func stringToBreakpointType(t string) (engineBreakpointType, error) {
 	}
 }
 
-// @TODO what about multiple breakpoints on the same c source code line?
 func breakpointStopGetID(notification map[string]interface{}) (string, bool) {
 	class, ok := notification["class"].(string)
 	if !ok || class != "stopped" {
@@ -105,60 +152,244 @@ func breakpointStopGetID(notification map[string]interface{}) (string, bool) {
 		return "", false
 	}
 
-	breakPointNumString, ok := payload["bkptno"].(string)
+	reason, ok := payload["reason"].(string)
+	if !ok {
+		return "", false
+	}
+
+	switch reason {
+	case "breakpoint-hit":
+		breakPointNumString, ok := payload["bkptno"].(string)
+		return breakPointNumString, ok
+	case "watchpoint-trigger":
+		wpt, ok := payload["wpt"].(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+
+		watchPointNumString, ok := wpt["number"].(string)
+		return watchPointNumString, ok
+	}
+
+	return "", false
+}
+
+func isStoppedNotification(notification map[string]interface{}) bool {
+	class, ok := notification["class"].(string)
+	return ok && class == "stopped"
+}
+
+// rr reports "no-history" when running in reverse reaches the start of the trace.
+// At the end of the trace, rr usually stops the program with a SIGKILL just before it exits. This still allows
+// us to run in reverse from there. gdb could also report one of the "exited" stop reasons
+func traceBoundaryStopGetID(notification map[string]interface{}) (string, bool) {
+	class, ok := notification["class"].(string)
+	if !ok || class != "stopped" {
+		return "", false
+	}
+
+	payload, ok := notification["payload"].(map[string]interface{})
 	if !ok {
 		return "", false
 	}
 
 	reason, ok := payload["reason"].(string)
-	if !ok || reason != "breakpoint-hit" {
+	if !ok {
 		return "", false
 	}
 
-	return breakPointNumString, true
+	switch reason {
+	case "no-history":
+		return stopIDTraceStart, true
+	case "exited", "exited-normally", "exited-signalled":
+		return stopIDTraceEnd, true
+	case "signal-received":
+		signal, ok := payload["signal-name"].(string)
+		if ok && signal == "SIGKILL" {
+			return stopIDTraceEnd, true
+		}
+	}
+
+	return "", false
 }
 
+// The IDE may move a line breakpoint to another line (-n), change its hit value/condition (-h/-o) or its state (-s)
+// The breakpoint keeps its id even if the gdb breakpoint behind it is replaced
 func handleBreakpointUpdate(es *engineState, dCmd dbgpCmd) string {
 	d, ok := dCmd.options["d"]
 	if !ok {
-		panicWith(fmt.Sprint("Please provide breakpoint number for breakpoint_update. Got:", dCmd.fullCommand))
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_update", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Please provide the breakpoint id option -d")
 	}
 
-	_, ok = dCmd.options["n"]
-	if ok {
-		panicWith(fmt.Sprint("Line number updates are currently unsupported in breakpoint_update. Got:", dCmd.fullCommand))
+	bp, ok := es.breakpoints[d]
+	if !ok || bp.bpType == breakpointTypeInternal {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_update", dCmd.seqNum, breakpointErrorCodeNoSuchBreakpoint, "No such breakpoint: "+d)
 	}
 
-	_, ok = dCmd.options["h"]
-	if ok {
-		panicWith(fmt.Sprint("Hit condition/value update is currently not supported in breakpoint_update. Got:", dCmd.fullCommand))
+	hitValue, hitCondition, hitOk, err := parseHitCondition(dCmd)
+	if err != nil {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_update", dCmd.seqNum, dbgpErrorCodeInvalidOptions, err.Error())
 	}
 
-	_, ok = dCmd.options["o"]
-	if ok {
-		panicWith(fmt.Sprint("Hit condition/value update is currently not supported in breakpoint_update. Got:", dCmd.fullCommand))
+	s, sOk := dCmd.options["s"]
+	if sOk && s != "enabled" && s != "disabled" {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_update", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Unknown breakpoint state: "+xmlAttrEscape(s))
 	}
 
-	s, ok := dCmd.options["s"]
-	if !ok {
-		panicWith(fmt.Sprint("Please provide new breakpoint status in breakpoint_update. Got:", dCmd.fullCommand))
+	n, nOk := dCmd.options["n"]
+	if !nOk && !hitOk && !sOk {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_update", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Please provide a new line number -n, hit value -h, hit condition -o or state -s")
+	}
+
+	if hitOk && hitValue > 0 && bp.bpType == breakpointTypeWatch {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_update", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Hit conditions are not supported for watch breakpoints")
+	}
+
+	if nOk {
+		if bp.bpType != breakpointTypeLine && bp.bpType != breakpointTypeConditional {
+			return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_update", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Only line breakpoints can be moved to another line")
+		}
+
+		phpLineno, err := strconv.Atoi(n)
+		if err != nil {
+			return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_update", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Invalid line number: "+xmlAttrEscape(n))
+		}
+
+		phpLineno = nearestExecutableLine(es, bp.filename, phpLineno)
+		if phpLineno != bp.lineno {
+			breakErr := moveLineBreakpoint(es, bp, phpLineno)
+			if breakErr != nil {
+				return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_update", dCmd.seqNum, breakErr.code, breakErr.message)
+			}
+		}
+	}
+
+	if hitOk {
+		bp.hitValue = hitValue
+		bp.hitCondition = hitCondition
 	}
 
 	if s == "disabled" {
 		disableGdbBreakpoint(es, d)
 	} else if s == "enabled" {
 		enableGdbBreakpoint(es, d)
-	} else {
-		panicWith(fmt.Sprintf("Unknown breakpoint status %v for breakpoint_update", s))
 	}
 
 	return fmt.Sprintf(gBreakpointRemoveOrUpdateXMLResponseFormat, "breakpoint_update", dCmd.seqNum)
 }
 
+// Moves a line breakpoint to another line of the same file. See syncFileGdbBreakpoint()
+func moveLineBreakpoint(es *engineState, bp *engineBreakPoint, phpLineno int) *engineBreakpointError {
+	oldLineno := bp.lineno
+	bp.lineno = phpLineno
+	breakErr := syncFileGdbBreakpoint(es, bp.filename)
+	if breakErr != nil {
+		bp.lineno = oldLineno
+		return breakErr
+	}
+
+	// The hits counted so far were on the old line
+	bp.hitTicks = nil
+	bp.hitsCounted = false
+	bp.hitCount = 0
+
+	notifyBreakpointResolvedToIde(es, bp)
+	return nil
+}
+
+func handleBreakpointGet(es *engineState, dCmd dbgpCmd) string {
+	d, ok := dCmd.options["d"]
+	if !ok {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_get", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Please provide the breakpoint id option -d")
+	}
+
+	bp, ok := es.breakpoints[d]
+	if !ok || bp.bpType == breakpointTypeInternal {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_get", dCmd.seqNum, breakpointErrorCodeNoSuchBreakpoint, "No such breakpoint: "+d)
+	}
+
+	if !updateHitCounts(es) {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_get", dCmd.seqNum, dbgpErrorCodeNotAvailable, "Counting breakpoint hits was interrupted")
+	}
+
+	return fmt.Sprintf(gBreakpointGetXMLResponseFormat, dCmd.seqNum, breakpointXML(es, bp))
+}
+
+func handleBreakpointList(es *engineState, dCmd dbgpCmd) string {
+	if !updateHitCounts(es) {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_list", dCmd.seqNum, dbgpErrorCodeNotAvailable, "Counting breakpoint hits was interrupted")
+	}
+
+	var phpBreakpoints breakpointsByID
+	for _, bp := range es.breakpoints {
+		if bp.bpType != breakpointTypeInternal {
+			phpBreakpoints = append(phpBreakpoints, bp)
+		}
+	}
+	sort.Sort(phpBreakpoints)
+
+	var buf bytes.Buffer
+	for _, bp := range phpBreakpoints {
+		buf.WriteString(breakpointXML(es, bp))
+	}
+
+	return fmt.Sprintf(gBreakpointListXMLResponseFormat, dCmd.seqNum, buf.String())
+}
+
+// The <breakpoint> element used in the breakpoint_get and breakpoint_list responses
+func breakpointXML(es *engineState, bp *engineBreakPoint) string {
+	temporary := 0
+	if bp.temporary {
+		temporary = 1
+	}
+
+	extraAttrs := ""
+	if isLineBreakpoint(bp) && hasExecutableLines(es, bp.filename) {
+		// See nearestExecutableLine()
+		extraAttrs += " resolved=\"resolved\""
+	}
+
+	if bp.hitCondition != "" {
+		extraAttrs += fmt.Sprintf(" hit_condition=\"%v\"", xmlAttrEscape(string(bp.hitCondition)))
+	}
+
+	if bp.function != "" {
+		extraAttrs += fmt.Sprintf(" function=\"%v\"", xmlAttrEscape(bp.function))
+	}
+
+	if bp.exception != "" {
+		extraAttrs += fmt.Sprintf(" exception=\"%v\"", xmlAttrEscape(bp.exception))
+	}
+
+	expression := ""
+	if bp.expression != "" {
+		expression = fmt.Sprintf("<expression>%v</expression>", xmlAttrEscape(bp.expression))
+	}
+
+	return fmt.Sprintf(
+		gBreakpointXMLFormat,
+		bp.id,
+		bp.bpType,
+		xmlAttrEscape(bp.filename),
+		bp.lineno,
+		bp.state,
+		temporary,
+		bp.hitCount,
+		bp.hitValue,
+		extraAttrs,
+		expression,
+	)
+}
+
 func handleBreakpointRemove(es *engineState, dCmd dbgpCmd) string {
 	d, ok := dCmd.options["d"]
 	if !ok {
-		panicWith(fmt.Sprint("Please provide breakpoint id to remove. Got:", dCmd.fullCommand))
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_remove", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Please provide the breakpoint id option -d")
+	}
+
+	bp, ok := es.breakpoints[d]
+	if !ok || bp.bpType == breakpointTypeInternal {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_remove", dCmd.seqNum, breakpointErrorCodeNoSuchBreakpoint, "No such breakpoint: "+xmlAttrEscape(d))
 	}
 
 	removeGdbBreakpoint(es, d)
@@ -166,68 +397,129 @@ func handleBreakpointRemove(es *engineState, dCmd dbgpCmd) string {
 	return fmt.Sprintf(gBreakpointRemoveOrUpdateXMLResponseFormat, "breakpoint_remove", dCmd.seqNum)
 }
 
+// Conditional breakpoints are line breakpoints with a PHP expression (the data section of the command)
+// The expression is evaluated every time the line breakpoint is hit. See isFalseConditionalBreakpointHit()
 func handleBreakpointSetLineBreakpoint(es *engineState, dCmd dbgpCmd) string {
 	phpFilename, ok := dCmd.options["f"]
-	if !ok {
-		panicWith(fmt.Sprint("Please provide filename option -f in breakpoint_set. Got: ", dCmd.fullCommand))
+	if !ok || phpFilename == "" {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Please provide the filename option -f for the "+dCmd.options["t"]+" breakpoint")
 	}
 
-	status, ok := dCmd.options["s"]
-	disabled := false
-	if ok {
-		if status == "disabled" {
-			disabled = true
-		} else if status != "enabled" {
-			panicWith("Unknown breakpoint status: " + status)
+	bpType := breakpointTypeLine
+	expression := ""
+	if dCmd.options["t"] == string(breakpointTypeConditional) {
+		if dCmd.data == "" {
+			return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Please provide an expression for the conditional breakpoint")
 		}
-	} else {
-		status = "enabled"
+
+		bpType = breakpointTypeConditional
+		expression = dCmd.data
+	}
+
+	status, disabled, temporary, err := parseBreakpointStatusAndTemporary(dCmd)
+	if err != nil {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, err.Error())
 	}
 
 	phpLinenoString, ok := dCmd.options["n"]
 	if !ok {
-		panicWith(fmt.Sprint("Please provide line number option -n in breakpoint_set. Got:", dCmd.fullCommand))
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Please provide the line number option -n for the "+dCmd.options["t"]+" breakpoint")
 	}
 
-	r, ok := dCmd.options["r"]
-	temporary := false
-	if ok && r == "1" {
-		temporary = true
+	hitValue, hitCondition, _, err := parseHitCondition(dCmd)
+	if err != nil {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, err.Error())
 	}
 
-	_, ok = dCmd.options["h"]
-	if ok {
-		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, breakpointErrorCodeTypeNotSupported, "Hit condition/value is currently not supported")
+	phpLineno, err := strconv.Atoi(phpLinenoString)
+	if err != nil || phpLineno < 1 {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Invalid line number: "+xmlAttrEscape(phpLinenoString))
 	}
 
-	_, ok = dCmd.options["o"]
-	if ok {
-		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, breakpointErrorCodeTypeNotSupported, "Hit condition/value is currently not supported")
+	// The IDE may ask for a breakpoint on a blank line, a comment etc. which would never be hit
+	resolvedLineno := nearestExecutableLine(es, phpFilename, phpLineno)
+	if resolvedLineno != phpLineno {
+		Verbosef("dontbug: Moved breakpoint at %v:%v to line %v, the next line with a PHP statement\n", phpFilename, phpLineno, resolvedLineno)
+		phpLineno = resolvedLineno
 	}
 
-	phpLineno, err := strconv.Atoi(phpLinenoString)
-	panicIf(err)
+	responseFormat := gBreakpointSetXMLResponseFormat
+	if hasExecutableLines(es, phpFilename) {
+		responseFormat = gBreakpointSetLineResolvedXMLResponseFormat
+	}
+
+	response, ok := matchingBreakpointSetResponse(es, dCmd, responseFormat, &engineBreakPoint{
+		bpType:       bpType,
+		filename:     phpFilename,
+		lineno:       phpLineno,
+		state:        engineBreakpointState(status),
+		temporary:    temporary,
+		hitValue:     hitValue,
+		hitCondition: hitCondition,
+		expression:   expression,
+	})
+	if ok {
+		return response
+	}
 
 	id, breakErr := setPhpBreakpointInGdb(es, phpFilename, phpLineno, disabled, temporary)
 	if breakErr != nil {
 		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, breakErr.code, breakErr.message)
 	}
 
-	return fmt.Sprintf(gBreakpointSetLineXMLResponseFormat, dCmd.seqNum, status, id)
+	es.breakpoints[id].bpType = bpType
+	es.breakpoints[id].expression = expression
+	es.breakpoints[id].hitValue = hitValue
+	es.breakpoints[id].hitCondition = hitCondition
+
+	notifyBreakpointResolvedToIde(es, es.breakpoints[id])
+
+	return fmt.Sprintf(responseFormat, dCmd.seqNum, status, id)
+}
+
+// Parses the -s (state) and -r (temporary) options of breakpoint_set
+func parseBreakpointStatusAndTemporary(dCmd dbgpCmd) (string, bool, bool, error) {
+	status, ok := dCmd.options["s"]
+	disabled := false
+	if ok {
+		if status == "disabled" {
+			disabled = true
+		} else if status != "enabled" {
+			return "", false, false, errors.New("Unknown breakpoint state: " + xmlAttrEscape(status))
+		}
+	} else {
+		status = "enabled"
+	}
+
+	r, ok := dCmd.options["r"]
+	temporary := false
+	if ok && r == "1" {
+		temporary = true
+	}
+
+	return status, disabled, temporary, nil
 }
 
 func handleBreakpointSet(es *engineState, dCmd dbgpCmd) string {
 	t, ok := dCmd.options["t"]
 	if !ok {
-		panicWith(fmt.Sprint("Please provide breakpoint type option -t in breakpoint_set. Got:", dCmd.fullCommand))
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Please provide the breakpoint type option -t")
 	}
 
 	tt, err := stringToBreakpointType(t)
-	panicIf(err)
+	if err != nil {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, breakpointErrorCodeTypeNotSupported, "Breakpoint type "+xmlAttrEscape(t)+" is not supported")
+	}
 
 	switch tt {
-	case breakpointTypeLine:
+	case breakpointTypeLine, breakpointTypeConditional:
 		return handleBreakpointSetLineBreakpoint(es, dCmd)
+	case breakpointTypeCall, breakpointTypeReturn:
+		return handleBreakpointSetFunctionBreakpoint(es, dCmd, tt)
+	case breakpointTypeException:
+		return handleBreakpointSetExceptionBreakpoint(es, dCmd)
+	case breakpointTypeWatch:
+		return handleBreakpointSetWatchBreakpoint(es, dCmd)
 	default:
 		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, breakpointErrorCodeTypeNotSupported, "Breakpoint type "+tt+" is not supported")
 	}
@@ -268,15 +560,19 @@ func isEnabledPhpTemporaryBreakpoint(es *engineState, id string) bool {
 }
 
 func disableGdbBreakpoints(es *engineState, bpList []string) {
-	if len(bpList) > 0 {
-		sendGdbCommand(es.gdbSession, "break-disable", bpList...)
-		for _, el := range bpList {
-			bp, ok := es.breakpoints[el]
-			if ok {
-				bp.state = breakpointStateDisabled
-			}
+	gdbIDs := gdbIDsForPhpBreakpointIDs(es, bpList)
+	if len(gdbIDs) > 0 {
+		sendGdbCommand(es.gdbSession, "break-disable", gdbIDs...)
+	}
+
+	for _, el := range bpList {
+		bp, ok := es.breakpoints[el]
+		if ok {
+			bp.state = breakpointStateDisabled
 		}
 	}
+
+	syncFileGdbBreakpointsFor(es, bpList)
 }
 
 // convenience function
@@ -290,6 +586,10 @@ func disableAllGdbBreakpoints(es *engineState) {
 	for _, bp := range es.breakpoints {
 		bp.state = breakpointStateDisabled
 	}
+
+	for _, fb := range es.fileBreakpoints {
+		fb.enabled = false
+	}
 }
 
 func enableAllGdbBreakpoints(es *engineState) {
@@ -297,18 +597,27 @@ func enableAllGdbBreakpoints(es *engineState) {
 	for _, bp := range es.breakpoints {
 		bp.state = breakpointStateEnabled
 	}
+
+	for _, fb := range es.fileBreakpoints {
+		fb.enabled = true
+	}
+	syncAllFileGdbBreakpoints(es)
 }
 
 func enableGdbBreakpoints(es *engineState, bpList []string) {
-	if len(bpList) > 0 {
-		sendGdbCommand(es.gdbSession, "break-enable", bpList...)
-		for _, el := range bpList {
-			bp, ok := es.breakpoints[el]
-			if ok {
-				bp.state = breakpointStateEnabled
-			}
+	gdbIDs := gdbIDsForPhpBreakpointIDs(es, bpList)
+	if len(gdbIDs) > 0 {
+		sendGdbCommand(es.gdbSession, "break-enable", gdbIDs...)
+	}
+
+	for _, el := range bpList {
+		bp, ok := es.breakpoints[el]
+		if ok {
+			bp.state = breakpointStateEnabled
 		}
 	}
+
+	syncFileGdbBreakpointsFor(es, bpList)
 }
 
 func getAssocEnabledPhpBreakpoint(es *engineState, filename string, lineno int) (string, bool) {
@@ -324,67 +633,101 @@ func getAssocEnabledPhpBreakpoint(es *engineState, filename string, lineno int)
 	return "", false
 }
 
-// convenience function
-func enableGdbBreakpoint(es *engineState, bp string) {
-	enableGdbBreakpoints(es, []string{bp})
+// Returns the id of an unclaimed breakpoint (see setUnclaimedBreakpoints()) that is identical to the one being
+// asked for. The IDE owns that breakpoint from then on. Any other breakpoint the IDE sets gets an id of its own, even if it
+// is identical to an existing one, as the IDE can remove each of them separately
+func getMatchingPhpBreakpoint(es *engineState, want *engineBreakPoint) (string, bool) {
+	for name, bp := range es.breakpoints {
+		if bp.unclaimed &&
+			bp.bpType == want.bpType &&
+			bp.filename == want.filename &&
+			bp.lineno == want.lineno &&
+			bp.state == want.state &&
+			bp.temporary == want.temporary &&
+			bp.hitValue == want.hitValue &&
+			bp.hitCondition == want.hitCondition &&
+			bp.function == want.function &&
+			bp.exception == want.exception &&
+			bp.expression == want.expression {
+			bp.unclaimed = false
+			return name, true
+		}
+	}
+
+	return "", false
 }
 
-// Sets an equivalent breakpoint in gdb for PHP
-// Also inserts the breakpoint into es.Breakpoints table
-func setPhpBreakpointInGdb(es *engineState, phpFilename string, phpLineno int, disabled bool, temporary bool) (string, *engineBreakpointError) {
-	internalLineno, ok := es.sourceMap[phpFilename]
+// The IDE may ask for a breakpoint that was restored from a saved session or set from the dontbug prompt
+// Returns the breakpoint_set response with the id of that breakpoint if so. See getMatchingPhpBreakpoint()
+func matchingBreakpointSetResponse(es *engineState, dCmd dbgpCmd, responseFormat string, want *engineBreakPoint) (string, bool) {
+	id, ok := getMatchingPhpBreakpoint(es, want)
 	if !ok {
-		warning := fmt.Sprintf("dontbug: [This warning is usually harmless and can be ignored] Warning: Not able to find %v to add a breakpoint. The IDE is either trying to set a breakpoint for a file from a different project or the root directory command line parameter was not specified correctly.", phpFilename)
-		color.Yellow(warning)
-		return "", &engineBreakpointError{breakpointErrorCodeCouldNotSet, warning}
+		return "", false
 	}
 
-	breakpointState := breakpointStateEnabled
-	disabledFlag := ""
-	if disabled {
-		disabledFlag = "-d " // Note the space after -d
-		breakpointState = breakpointStateDisabled
-	}
+	return fmt.Sprintf(responseFormat, dCmd.seqNum, want.state, id), true
+}
 
-	temporaryFlag := ""
-	if temporary {
-		temporaryFlag = "-t " // Note the space after -t
+// For breakpoints the IDE did not ask for. They're only marked unclaimed once they're all set so that identical
+// ones don't match each other. Returns the breakpoint_set response for each of the commands
+func setUnclaimedBreakpoints(es *engineState, dCmds []dbgpCmd) []string {
+	preexisting := make(map[string]bool, len(es.breakpoints))
+	for id := range es.breakpoints {
+		preexisting[id] = true
 	}
 
-	breakInsertAr := []string{
-		"-f",
-		"-c",
-		fmt.Sprintf("\"lineno == %v\"", phpLineno),
-		"--source",
-		"dontbug_break.c",
-		"--line",
-		strconv.Itoa(internalLineno),
+	var responses []string
+	for _, dCmd := range dCmds {
+		responses = append(responses, handleBreakpointSet(es, dCmd))
 	}
 
-	if temporary {
-		breakInsertAr = append(breakInsertAr, temporaryFlag)
+	for id, bp := range es.breakpoints {
+		if !preexisting[id] && bp.bpType != breakpointTypeInternal {
+			bp.unclaimed = true
+		}
 	}
 
-	if disabled {
-		breakInsertAr = append(breakInsertAr, disabledFlag)
-	}
+	return responses
+}
 
-	result := sendGdbCommand(es.gdbSession, "break-insert", breakInsertAr...);
-	if result["class"] != "done" {
-		warning := fmt.Sprintf("dontbug: Could not set breakpoint in gdb backend at %v:%v. Something is probably wrong with breakpoint parameters", phpFilename, phpLineno)
-		color.Red(warning)
-		return "", &engineBreakpointError{breakpointErrorCodeCouldNotSet, warning}
+// The breakpoints of an IDE that has gone away. A new IDE will send the breakpoints it wants
+func removeIdeBreakpoints(es *engineState) {
+	for id, bp := range es.breakpoints {
+		if bp.bpType != breakpointTypeInternal && !bp.unclaimed {
+			removeGdbBreakpoint(es, id)
+		}
 	}
+}
 
-	payload := result["payload"].(map[string]interface{})
-	bkpt := payload["bkpt"].(map[string]interface{})
-	id := bkpt["number"].(string)
+// convenience function
+func enableGdbBreakpoint(es *engineState, bp string) {
+	enableGdbBreakpoints(es, []string{bp})
+}
 
-	_, ok = es.breakpoints[id]
-	if ok {
-		log.Fatal("Breakpoint number returned by gdb not unique: ", id)
+// Sets an equivalent breakpoint in gdb for PHP
+// Also inserts the breakpoint into es.Breakpoints table
+// Note that gdb gets one breakpoint per PHP file and not one per line breakpoint. See syncFileGdbBreakpoint()
+func setPhpBreakpointInGdb(es *engineState, phpFilename string, phpLineno int, disabled bool, temporary bool) (string, *engineBreakpointError) {
+	if !isInSourceMap(es, phpFilename) {
+		if es.fallbackBreakLine == 0 {
+			warning := fmt.Sprintf("dontbug: [This warning is usually harmless and can be ignored] Warning: Not able to find %v to add a breakpoint. The IDE is either trying to set a breakpoint for a file from a different project or the root directory command line parameter was not specified correctly. Running `dontbug record` again will allow breakpoints in such files too.", phpFilename)
+			color.Yellow(warning)
+			return "", &engineBreakpointError{breakpointErrorCodeCouldNotSet, warning}
+		}
+
+		// Only tell the user the first time around for a file
+		_, ok := es.fileBreakpoints[phpFilename]
+		if !ok {
+			color.Yellow("dontbug: %v was not found when dontbug_break.c was generated. Breakpoints in it will work but will slow down execution considerably. Specify the correct root directory in `dontbug record` to avoid this", phpFilename)
+		}
+	}
+
+	breakpointState := breakpointStateEnabled
+	if disabled {
+		breakpointState = breakpointStateDisabled
 	}
 
+	id := nextPhpBreakpointID(es)
 	es.breakpoints[id] = &engineBreakPoint{
 		id:        id,
 		filename:  phpFilename,
@@ -394,6 +737,12 @@ func setPhpBreakpointInGdb(es *engineState, phpFilename string, phpLineno int, d
 		bpType:    breakpointTypeLine,
 	}
 
+	breakErr := syncFileGdbBreakpoint(es, phpFilename)
+	if breakErr != nil {
+		delete(es.breakpoints, id)
+		return "", breakErr
+	}
+
 	return id, nil
 }
 
@@ -420,10 +769,17 @@ func setPhpStackDepthLevelBreakpointInGdb(es *engineState, level int) string {
 }
 
 func removeGdbBreakpoint(es *engineState, id string) {
-	sendGdbCommand(es.gdbSession, "break-delete", id)
-	_, ok := es.breakpoints[id]
+	gdbID := gdbIDForPhpBreakpointID(es, id)
+	if gdbID != "" {
+		sendGdbCommand(es.gdbSession, "break-delete", gdbID)
+	}
+
+	bp, ok := es.breakpoints[id]
 	if ok {
 		delete(es.breakpoints, id)
+		if isLineBreakpoint(bp) {
+			syncFileGdbBreakpoint(es, bp.filename)
+		}
 	}
 }
 
@@ -433,3 +789,47 @@ func gotoMasterBpLocation(es *engineState, reverse bool) (string, bool) {
 	disableGdbBreakpoint(es, dontbugMasterBp)
 	return id, ok
 }
+
+// Same as gotoMasterBpLocation() but PHP breakpoints on the way are ignored
+func gotoMasterBpLocationWithNoPhpBpts(es *engineState, reverse bool) (string, bool) {
+	bpList := getEnabledPhpBreakpoints(es)
+	disableGdbBreakpoints(es, bpList)
+	id, ok := gotoMasterBpLocation(es, reverse)
+	enableGdbBreakpoints(es, bpList)
+	return id, ok
+}
+
+// PHP breakpoint ids are not gdb breakpoint numbers. See nextPhpBreakpointID(). The gdb breakpoint behind a PHP
+// breakpoint can also change e.g. watch breakpoints get a new gdb watchpoint when the variable is resolved again
+// Returns the id the IDE knows the breakpoint by
+func phpBreakpointIDForGdbID(es *engineState, gdbID string) string {
+	for id, bp := range es.breakpoints {
+		if bp.bpType != breakpointTypeInternal && bp.gdbID != "" && bp.gdbID == gdbID {
+			return id
+		}
+	}
+
+	return gdbID
+}
+
+// The reverse of phpBreakpointIDForGdbID(). Returns "" for a watch breakpoint that is not resolved at the moment
+func gdbIDForPhpBreakpointID(es *engineState, id string) string {
+	bp, ok := es.breakpoints[id]
+	if ok && bp.bpType != breakpointTypeInternal {
+		return bp.gdbID
+	}
+
+	return id
+}
+
+func gdbIDsForPhpBreakpointIDs(es *engineState, bpList []string) []string {
+	var gdbIDs []string
+	for _, id := range bpList {
+		gdbID := gdbIDForPhpBreakpointID(es, id)
+		if gdbID != "" {
+			gdbIDs = append(gdbIDs, gdbID)
+		}
+	}
+
+	return gdbIDs
+}
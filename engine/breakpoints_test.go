@@ -0,0 +1,109 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Bad options get an error response and never make it to gdb. A panic would close the connection to the IDE
+func TestBreakpointCommandOptionErrors(t *testing.T) {
+	es := &engineState{
+		breakpoints: map[string]*engineBreakPoint{
+			"1": {id: "1", bpType: breakpointTypeInternal, filename: "dontbug.c", lineno: 114, state: breakpointStateDisabled},
+		},
+	}
+
+	tests := []struct {
+		command  string
+		expected int // error code
+	}{
+		{"breakpoint_remove -i 1", 3},
+		{"breakpoint_remove -i 2 -d 12345", 205},
+		{"breakpoint_remove -i 3 -d 1", 205},
+		{"breakpoint_set -i 4", 3},
+		{"breakpoint_set -i 5 -t bogus", 201},
+		{"breakpoint_set -i 6 -t line -n 3", 3},
+		{"breakpoint_set -i 7 -t line -f file:///var/www/index.php", 3},
+		{"breakpoint_set -i 8 -t line -f file:///var/www/index.php -n three", 3},
+		{"breakpoint_set -i 9 -t line -f file:///var/www/index.php -n 3 -s bogus", 3},
+		{"breakpoint_set -i 10 -t call -m strlen -s bogus", 3},
+		{"breakpoint_set -i 11 -t exception -x Exception -s bogus", 3},
+	}
+
+	for _, test := range tests {
+		dCmd, err := parseCommand(test.command, false)
+		if err != nil {
+			t.Fatalf("parseCommand(%v): %v", test.command, err)
+		}
+
+		response := gDbgpCmdHandlers[dCmd.command](es, dCmd)
+		expected := fmt.Sprintf(`<error code="%v">`, test.expected)
+		if !strings.Contains(response, expected) {
+			t.Errorf("%v: expected a response with %v, got %v", test.command, expected, response)
+		}
+	}
+
+	if len(es.breakpoints) != 1 {
+		t.Errorf("expected no breakpoints to be set or removed, got %v", len(es.breakpoints))
+	}
+}
+
+// Only an unclaimed breakpoint is handed to the IDE and only once. Identical breakpoints the IDE sets are kept apart
+func TestGetMatchingPhpBreakpoint(t *testing.T) {
+	es := &engineState{
+		breakpoints: map[string]*engineBreakPoint{
+			"10001": {id: "10001", bpType: breakpointTypeLine, filename: "file:///var/www/index.php", lineno: 3, state: breakpointStateEnabled, unclaimed: true},
+			"10002": {id: "10002", bpType: breakpointTypeLine, filename: "file:///var/www/index.php", lineno: 5, state: breakpointStateEnabled},
+		},
+	}
+
+	want := &engineBreakPoint{bpType: breakpointTypeLine, filename: "file:///var/www/index.php", lineno: 3, state: breakpointStateEnabled}
+	id, ok := getMatchingPhpBreakpoint(es, want)
+	if !ok || id != "10001" {
+		t.Errorf("expected the unclaimed breakpoint 10001, got %v, %v", id, ok)
+	}
+
+	_, ok = getMatchingPhpBreakpoint(es, want)
+	if ok {
+		t.Error("expected a second identical breakpoint_set to get a breakpoint of its own")
+	}
+
+	want.lineno = 5
+	_, ok = getMatchingPhpBreakpoint(es, want)
+	if ok {
+		t.Error("expected a breakpoint the IDE set not to be handed out again")
+	}
+}
+
+// A new IDE sends the breakpoints it wants. Only those the previous IDE did not set remain
+func TestRemoveIdeBreakpoints(t *testing.T) {
+	es := &engineState{
+		breakpoints: map[string]*engineBreakPoint{
+			"1":     {id: "1", bpType: breakpointTypeInternal, filename: "dontbug.c", lineno: 114, state: breakpointStateDisabled},
+			"10001": {id: "10001", bpType: breakpointTypeLine, filename: "file:///var/www/index.php", lineno: 3, state: breakpointStateEnabled},
+			"10002": {id: "10002", bpType: breakpointTypeLine, filename: "file:///var/www/lib.php", lineno: 5, state: breakpointStateEnabled, unclaimed: true},
+		},
+	}
+
+	removeIdeBreakpoints(es)
+
+	_, ok := es.breakpoints["10001"]
+	if ok || len(es.breakpoints) != 2 {
+		t.Errorf("expected only the breakpoint set by the IDE to be removed, got %v", es.breakpoints)
+	}
+}
@@ -0,0 +1,434 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"github.com/fatih/color"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The parts of an Xdebug eval response we care about
+type dbgpEvalResponse struct {
+	XMLName xml.Name `xml:"response"`
+	Error   *struct {
+		Code int `xml:"code,attr"`
+	} `xml:"error"`
+	Property *struct {
+		Type     string `xml:"type,attr"`
+		Encoding string `xml:"encoding,attr"`
+		Value    string `xml:",chardata"`
+	} `xml:"property"`
+}
+
+// Returns true if the breakpoint is a conditional one and its condition does not hold right now
+// Such a hit should be skipped silently, whichever direction we happen to be running in
+func isFalseConditionalBreakpointHit(es *engineState, id string) bool {
+	bp, ok := es.breakpoints[id]
+	if !ok || bp.bpType != breakpointTypeConditional || bp.state != breakpointStateEnabled {
+		return false
+	}
+
+	return !phpExpressionIsTrue(es, bp.expression)
+}
+
+// Evaluates (bool)(expression) in PHP at the current point in the trace
+// An expression that cannot be evaluated (e.g. a syntax error) is considered false
+func phpExpressionIsTrue(es *engineState, expression string) bool {
+	encoded := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("(bool)(%v)", expression)))
+	result := diversionSessionCmdWithNoGdbBpts(es, fmt.Sprintf("eval -i %v -- %v", es.lastSequenceNum, encoded))
+
+	var response dbgpEvalResponse
+	err := xml.Unmarshal([]byte(result), &response)
+	if err != nil {
+		color.Yellow("dontbug: Could not understand the result of evaluating breakpoint condition: %v", expression)
+		return false
+	}
+
+	if response.Error != nil || response.Property == nil {
+		Verboseln(fmt.Sprintf("dontbug: Breakpoint condition could not be evaluated, treating it as false: %v", expression))
+		return false
+	}
+
+	value := response.Property.Value
+	if response.Property.Encoding == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return false
+		}
+		value = string(decoded)
+	}
+
+	return response.Property.Type == "bool" && value == "1"
+}
+
+// Like diversionSessionCmd() but with every gdb breakpoint disabled while PHP code runs in the diversion
+// session. Unlike handleInDiversionSessionWithNoGdbBpts(), this can be used in the middle of a run/step
+// as internal gdb breakpoints (e.g. the stack level breakpoints used for stepping) are restored too
+func diversionSessionCmdWithNoGdbBpts(es *engineState, command string) string {
+	var result string
+	withAllGdbBreakpointsDisabled(es, func() {
+		result = diversionSessionCmd(es, command)
+	})
+
+	return result
+}
+
+// Runs f with every gdb breakpoint disabled. The breakpoints that were enabled are enabled again afterwards
+func withAllGdbBreakpointsDisabled(es *engineState, f func()) {
+	enabled := getEnabledGdbBreakpointNumbers(es)
+	if len(enabled) > 0 {
+		sendGdbCommand(es.gdbSession, "break-disable", enabled...)
+	}
+
+	f()
+
+	if len(enabled) > 0 {
+		sendGdbCommand(es.gdbSession, "break-enable", enabled...)
+	}
+}
+
+// Asks gdb directly, as internal breakpoints are not always in the es.breakpoints table
+func getEnabledGdbBreakpointNumbers(es *engineState) []string {
+	result := sendGdbCommand(es.gdbSession, "break-list")
+	payload, ok := result["payload"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	table, ok := payload["BreakpointTable"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	body, ok := table["body"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var enabled []string
+	for _, el := range body {
+		bkpt, ok := el.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		// Each element may be wrapped as bkpt={...}
+		inner, ok := bkpt["bkpt"].(map[string]interface{})
+		if ok {
+			bkpt = inner
+		}
+
+		number, ok := bkpt["number"].(string)
+		if ok && bkpt["enabled"] == "y" {
+			enabled = append(enabled, number)
+		}
+	}
+
+	return enabled
+}
+
+// rr's position in the trace, in terms of the ticks (retired conditional branches) of the PHP process
+// This always increases as the program runs so it serves as an absolute position in the recording
+func currentRRTicks(es *engineState) int64 {
+	output := xGdbConsoleCmd(es, "when-ticks")
+
+	// Looks like: Current tick: 12345
+	colon := strings.LastIndex(output, ":")
+	ticks, err := strconv.ParseInt(strings.TrimSpace(output[colon+1:]), 10, 64)
+	panicIf(err)
+
+	return ticks
+}
+
+// Returns true if a hit on a PHP breakpoint should be skipped silently i.e. its condition
+// does not hold or its hit condition is not satisfied (or it is a stale watch breakpoint hit)
+func shouldSkipBreakpointHit(es *engineState, id string) bool {
+	bp, ok := es.breakpoints[id]
+	if !ok || bp.bpType == breakpointTypeInternal || bp.state != breakpointStateEnabled {
+		return false
+	}
+
+	if isStaleWatchBreakpointHit(es, bp) {
+		return true
+	}
+
+	if isFalseConditionalBreakpointHit(es, id) {
+		return true
+	}
+
+	// Don't bother asking rr for the ticks on every hit of a breakpoint without a hit condition
+	if bp.hitValue <= 0 {
+		return false
+	}
+
+	if !countBreakpointHitsInTrace(es, []*engineBreakPoint{bp}) {
+		// Interrupted. The run this hit is part of will stop soon enough
+		return true
+	}
+
+	return !hitConditionHoldsAt(bp, currentRRTicks(es))
+}
+
+// Hit counts are against the whole trace and not just the part of it we have gone over. So a hit condition holds
+// at the same hits whether we get to them running forwards, in reverse or after jumping about in the trace
+func hitConditionHoldsAt(bp *engineBreakPoint, ticks int64) bool {
+	bp.hitCount = hitCountAt(bp, ticks)
+	return hitConditionHolds(bp)
+}
+
+// The number of hits at or before ticks. See countBreakpointHitsInTrace()
+func hitCountAt(bp *engineBreakPoint, ticks int64) int {
+	return sort.Search(len(bp.hitTicks), func(i int) bool { return bp.hitTicks[i] > ticks })
+}
+
+// Goes over the whole trace, from its start, noting the rr ticks of every hit of the breakpoints (that have not been
+// counted so far). We then return to exactly where we were via an rr checkpoint. This is a run (see beginRun()) so
+// it can be interrupted, in which case false is returned and the breakpoints remain uncounted
+//
+// Watch breakpoints are never counted. Their gdb watchpoint is on a PHP variable of a particular stack frame
+func countBreakpointHitsInTrace(es *engineState, bps []*engineBreakPoint) bool {
+	lineBreakpoints := map[string][]*engineBreakPoint{} // PHP filename -> line breakpoints
+	var hookBreakpoints []*engineBreakPoint
+	for _, bp := range bps {
+		if bp.hitsCounted {
+			continue
+		}
+
+		if isLineBreakpoint(bp) {
+			lineBreakpoints[bp.filename] = append(lineBreakpoints[bp.filename], bp)
+		} else if bp.hookFunction != "" {
+			hookBreakpoints = append(hookBreakpoints, bp)
+		}
+	}
+
+	if len(lineBreakpoints) == 0 && len(hookBreakpoints) == 0 {
+		return true
+	}
+
+	// There is no coming back to the end of the trace via a checkpoint. But that is where the pass ends anyway
+	checkpoint := ""
+	if es.status != statusStopping {
+		var err error
+		checkpoint, err = createRRCheckpoint(es)
+		if err != nil {
+			color.Red("dontbug: Could not count breakpoint hits: %v", err)
+			return false
+		}
+		defer deleteRRCheckpoint(es, checkpoint)
+	}
+
+	color.Yellow("dontbug: Counting breakpoint hits over the whole trace. This may take a while")
+	hitTicks := map[*engineBreakPoint][]int64{}
+	interrupted := false
+	withAllGdbBreakpointsDisabled(es, func() {
+		beginRun(es)
+		defer endRun(es)
+
+		// gdb breakpoint -> the PHP file whose line breakpoints are behind it (or the hook breakpoint)
+		gdbFiles := map[string]string{}
+		gdbHooks := map[string]*engineBreakPoint{}
+		for phpFilename, fileBps := range lineBreakpoints {
+			linenos := map[int]bool{}
+			for _, bp := range fileBps {
+				linenos[bp.lineno] = true
+			}
+
+			gdbID, breakErr := insertFileGdbBreakpoint(es, phpFilename, linesBreakpointCondition(es, phpFilename, linenos))
+			if breakErr == nil {
+				gdbFiles[gdbID] = phpFilename
+			}
+		}
+
+		for _, bp := range hookBreakpoints {
+			gdbID, breakErr := setPhpHookBreakpointInGdb(es, bp.hookFunction, bp.hookCondition, false, false)
+			if breakErr == nil {
+				gdbHooks[gdbID] = bp
+			}
+		}
+
+		defer func() {
+			for gdbID := range gdbFiles {
+				sendGdbCommand(es.gdbSession, "break-delete", gdbID)
+			}
+			for gdbID := range gdbHooks {
+				sendGdbCommand(es.gdbSession, "break-delete", gdbID)
+			}
+		}()
+
+		if !restartAtRREvent(es, 1) {
+			color.Red("dontbug: Could not go to the start of the trace to count breakpoint hits")
+			interrupted = true
+			return
+		}
+
+		for {
+			if !resumeUnlessInterrupted(es, false) {
+				interrupted = true
+				break
+			}
+
+			gdbID := <-es.breakStopNotify
+			gdbStopped(es)
+			if gdbID == stopIDTraceEnd {
+				break
+			}
+
+			if gdbID == stopIDInterrupted && takeInterruptRequest(es) {
+				interrupted = true
+				break
+			}
+
+			phpFilename, ok := gdbFiles[gdbID]
+			if ok {
+				phpLineno := xSlashDgdb(es.gdbSession, "lineno")
+				for _, bp := range lineBreakpoints[phpFilename] {
+					if bp.lineno != phpLineno {
+						continue
+					}
+
+					if bp.bpType == breakpointTypeConditional && !phpExpressionIsTrue(es, bp.expression) {
+						continue
+					}
+
+					hitTicks[bp] = append(hitTicks[bp], currentRRTicks(es))
+				}
+			}
+
+			bp, ok := gdbHooks[gdbID]
+			if ok {
+				hitTicks[bp] = append(hitTicks[bp], currentRRTicks(es))
+			}
+		}
+
+		if !interrupted {
+			return
+		}
+
+		// The run this count is part of (if any) needs to stop too
+		requestInterrupt(es)
+
+		if checkpoint == "" {
+			// Back to the end of the trace. Nothing else can stop us with every gdb breakpoint disabled
+			for {
+				sendGdbCommand(es.gdbSession, "exec-continue")
+				if <-es.breakStopNotify == stopIDTraceEnd {
+					break
+				}
+			}
+		}
+	})
+
+	if checkpoint != "" && !restartFromRRCheckpoint(es, checkpoint) {
+		panicWith("Could not return to where we were after counting breakpoint hits")
+	}
+
+	if interrupted {
+		color.Yellow("dontbug: Counting breakpoint hits was interrupted")
+		return false
+	}
+
+	for _, fileBps := range lineBreakpoints {
+		for _, bp := range fileBps {
+			bp.hitTicks = hitTicks[bp]
+			bp.hitsCounted = true
+		}
+	}
+
+	for _, bp := range hookBreakpoints {
+		bp.hitTicks = hitTicks[bp]
+		bp.hitsCounted = true
+	}
+
+	return true
+}
+
+// The hit counts reported to the IDE depend on where we are in the trace
+// Returns false if counting the hits was interrupted. See countBreakpointHitsInTrace()
+func updateHitCounts(es *engineState) bool {
+	var bps []*engineBreakPoint
+	for _, bp := range es.breakpoints {
+		if bp.bpType != breakpointTypeInternal && bp.bpType != breakpointTypeWatch {
+			bps = append(bps, bp)
+		}
+	}
+
+	if !countBreakpointHitsInTrace(es, bps) {
+		return false
+	}
+
+	if es.status == statusStopping {
+		// Everything has happened at this point
+		for _, bp := range bps {
+			bp.hitCount = len(bp.hitTicks)
+		}
+		return true
+	}
+
+	ticks := currentRRTicks(es)
+	for _, bp := range bps {
+		bp.hitCount = hitCountAt(bp, ticks)
+	}
+
+	return true
+}
+
+func hitConditionHolds(bp *engineBreakPoint) bool {
+	if bp.hitValue <= 0 {
+		return true
+	}
+
+	switch bp.hitCondition {
+	case breakpointHitCondEq:
+		return bp.hitCount == bp.hitValue
+	case breakpointHitCondMod:
+		return bp.hitCount%bp.hitValue == 0
+	default:
+		return bp.hitCount >= bp.hitValue
+	}
+}
+
+// Parses the -h (hit value) and -o (hit condition) options of breakpoint_set and breakpoint_update
+// Returns false if neither option was provided
+func parseHitCondition(dCmd dbgpCmd) (int, engineBreakpointCondition, bool, error) {
+	h, hOk := dCmd.options["h"]
+	o, oOk := dCmd.options["o"]
+	if !hOk && !oOk {
+		return 0, "", false, nil
+	}
+
+	hitValue := 0
+	if hOk {
+		var err error
+		hitValue, err = strconv.Atoi(h)
+		if err != nil || hitValue < 0 {
+			return 0, "", true, fmt.Errorf("Invalid hit value: %v", h)
+		}
+	}
+
+	hitCondition := breakpointHitCondGtEq
+	if oOk {
+		hitCondition = engineBreakpointCondition(o)
+		if hitCondition != breakpointHitCondGtEq && hitCondition != breakpointHitCondEq && hitCondition != breakpointHitCondMod {
+			return 0, "", true, fmt.Errorf("Invalid hit condition: %v", o)
+		}
+	}
+
+	return hitValue, hitCondition, true, nil
+}
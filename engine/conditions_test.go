@@ -0,0 +1,125 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHitCountAt(t *testing.T) {
+	bp := &engineBreakPoint{hitTicks: []int64{100, 300, 500, 700}}
+
+	tests := []struct {
+		ticks    int64
+		expected int
+	}{
+		{0, 0},
+		{99, 0},
+		{100, 1},
+		{101, 1},
+		{500, 3},
+		{699, 3},
+		{700, 4},
+		{10000, 4},
+	}
+
+	for _, test := range tests {
+		actual := hitCountAt(bp, test.ticks)
+		if actual != test.expected {
+			t.Errorf("hitCountAt(%v): expected %v, got %v", test.ticks, test.expected, actual)
+		}
+	}
+
+	if hitCountAt(&engineBreakPoint{}, 100) != 0 {
+		t.Error("hitCountAt: expected 0 for a breakpoint without hits")
+	}
+}
+
+func TestHitConditionHolds(t *testing.T) {
+	tests := []struct {
+		hitCount     int
+		hitValue     int
+		hitCondition engineBreakpointCondition
+		expected     bool
+	}{
+		// No hit value means every hit counts
+		{0, 0, "", true},
+		{5, 0, breakpointHitCondEq, true},
+
+		// >= is the default
+		{2, 3, "", false},
+		{3, 3, "", true},
+		{4, 3, breakpointHitCondGtEq, true},
+		{2, 3, breakpointHitCondGtEq, false},
+
+		{2, 3, breakpointHitCondEq, false},
+		{3, 3, breakpointHitCondEq, true},
+		{4, 3, breakpointHitCondEq, false},
+
+		{1, 2, breakpointHitCondMod, false},
+		{2, 2, breakpointHitCondMod, true},
+		{6, 3, breakpointHitCondMod, true},
+		{7, 3, breakpointHitCondMod, false},
+	}
+
+	for _, test := range tests {
+		bp := &engineBreakPoint{hitCount: test.hitCount, hitValue: test.hitValue, hitCondition: test.hitCondition}
+		actual := hitConditionHolds(bp)
+		if actual != test.expected {
+			t.Errorf("hitConditionHolds(hit count %v, %v %v): expected %v, got %v", test.hitCount,
+				test.hitCondition, test.hitValue, test.expected, actual)
+		}
+	}
+}
+
+// Running in reverse from the end of the trace goes over the hits last to first. The hit condition must still
+// hold at the same hits as when running forwards
+func TestHitConditionHoldsAtInReverse(t *testing.T) {
+	hitTicks := []int64{100, 300, 500, 700, 900}
+
+	tests := []struct {
+		hitValue     int
+		hitCondition engineBreakpointCondition
+		expected     []int64 // hits at which the condition holds
+	}{
+		{0, "", []int64{900, 700, 500, 300, 100}},
+		{1, breakpointHitCondEq, []int64{100}},
+		{4, breakpointHitCondEq, []int64{700}},
+		{3, breakpointHitCondGtEq, []int64{900, 700, 500}},
+		{2, breakpointHitCondMod, []int64{700, 300}},
+		{6, breakpointHitCondGtEq, nil},
+	}
+
+	for _, test := range tests {
+		bp := &engineBreakPoint{hitTicks: hitTicks, hitsCounted: true, hitValue: test.hitValue, hitCondition: test.hitCondition}
+
+		var actual []int64
+		for i := len(hitTicks) - 1; i >= 0; i-- {
+			if hitConditionHoldsAt(bp, hitTicks[i]) {
+				actual = append(actual, hitTicks[i])
+			}
+
+			if bp.hitCount != i+1 {
+				t.Errorf("hitConditionHoldsAt(%v): expected hit count %v, got %v", hitTicks[i], i+1, bp.hitCount)
+			}
+		}
+
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("hitConditionHoldsAt(%v %v) in reverse: expected to hold at %v, got %v", test.hitCondition,
+				test.hitValue, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"log"
+)
+
+type dbgpCmdHandler func(es *engineState, dCmd dbgpCmd) string
+
+// All the dbgp commands dontbug understands, keyed by command name e.g. stack_get
+// Handlers are added to this table via registerDbgpCmdHandler() in the init() function of each file
+var gDbgpCmdHandlers = make(map[string]dbgpCmdHandler)
+
+func registerDbgpCmdHandler(command string, handler dbgpCmdHandler) {
+	_, ok := gDbgpCmdHandlers[command]
+	if ok {
+		log.Fatal("dontbug: Sanity check failed. Duplicate handler for dbgp command: ", command)
+	}
+
+	gDbgpCmdHandlers[command] = handler
+}
+
+func dispatchIdeRequest(es *engineState, command string, reverseMode bool) string {
+	dbgpCmd, err := parseCommand(command, reverseMode)
+	es.lastSequenceNum = dbgpCmd.seqNum
+	if err != nil {
+		color.Yellow("dontbug: Could not parse dbgp command '%v': %v", command, err)
+		return fmt.Sprintf(gErrorXMLResponseFormat, dbgpCmd.command, dbgpCmd.seqNum, dbgpErrorCodeParse, xmlAttrEscape(err.Error()))
+	}
+
+	handler, ok := gDbgpCmdHandlers[dbgpCmd.command]
+	if !ok {
+		// Don't tear down the session. The IDE is usually just probing for an optional command
+		color.Yellow("dontbug: Unimplemented dbgp command: %v", command)
+		return fmt.Sprintf(gErrorXMLResponseFormat, dbgpCmd.command, dbgpCmd.seqNum, dbgpErrorCodeUnimplemented, "Unimplemented command: "+dbgpCmd.command)
+	}
+
+	return handler(es, dbgpCmd)
+}
@@ -0,0 +1,84 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	encodingUTF8   = "UTF-8"
+	encodingLatin1 = "ISO-8859-1"
+)
+
+// Returns the canonical name of an encoding the IDE asked for via feature_set -n encoding
+// Returns "", false if we don't support that encoding
+func normalizeDbgpEncoding(encoding string) (string, bool) {
+	switch strings.ToUpper(strings.TrimSpace(encoding)) {
+	case "UTF-8", "UTF8":
+		return encodingUTF8, true
+	case "ISO-8859-1", "ISO8859-1", "LATIN1":
+		return encodingLatin1, true
+	}
+
+	return "", false
+}
+
+// The encoding the IDE expects dbgp packets to be in
+func dbgpEncoding(es *engineState) string {
+	encoding, ok := es.featureMap["encoding"].(*engineFeatureString)
+	if !ok {
+		return encodingLatin1
+	}
+
+	return encoding.value
+}
+
+// Internally, all strings are UTF-8. PHP strings are just bytes though, so anything
+// coming out of the diversion session that is not valid UTF-8 is assumed to be ISO-8859-1
+func toUTF8(input string) string {
+	if utf8.ValidString(input) {
+		return input
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < len(input); i++ {
+		buf.WriteRune(rune(input[i]))
+	}
+
+	return buf.String()
+}
+
+// Converts our (UTF-8) strings into the encoding the IDE wants
+// input is xml so characters that cannot be represented in ISO-8859-1 become character references e.g. &#x20ac;
+func fromUTF8(input string, encoding string) []byte {
+	if encoding == encodingUTF8 {
+		return []byte(input)
+	}
+
+	var buf bytes.Buffer
+	for _, c := range input {
+		if c > 0xff {
+			fmt.Fprintf(&buf, "&#x%x;", c)
+		} else {
+			buf.WriteByte(byte(c))
+		}
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,82 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"testing"
+)
+
+func TestToUTF8(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"", ""},
+		{"plain ascii", "plain ascii"},
+		{"caf\xc3\xa9", "café"},   // already UTF-8
+		{"caf\xe9", "café"},       // ISO-8859-1
+		{"\xff\xfe", "ÿþ"},        // not valid UTF-8 so taken to be ISO-8859-1
+		{"\xe2\x82\xac 5", "€ 5"}, // euro sign in UTF-8
+	}
+
+	for _, test := range tests {
+		actual := toUTF8(test.input)
+		if actual != test.expected {
+			t.Errorf("toUTF8(%q): expected %q, got %q", test.input, test.expected, actual)
+		}
+	}
+}
+
+func TestFromUTF8(t *testing.T) {
+	tests := []struct {
+		input    string
+		encoding string
+		expected string
+	}{
+		{"café", encodingUTF8, "caf\xc3\xa9"},
+		{"café", encodingLatin1, "caf\xe9"},
+		{"€ 5", encodingUTF8, "\xe2\x82\xac 5"},
+		{"€ 5", encodingLatin1, "&#x20ac; 5"},
+		{"<a n=\"中é\"/>", encodingLatin1, "<a n=\"&#x4e2d;\xe9\"/>"},
+		{"\U0001f600", encodingLatin1, "&#x1f600;"},
+	}
+
+	for _, test := range tests {
+		actual := string(fromUTF8(test.input, test.encoding))
+		if actual != test.expected {
+			t.Errorf("fromUTF8(%q, %v): expected %q, got %q", test.input, test.encoding, test.expected, actual)
+		}
+	}
+}
+
+// Anything PHP gives us that is representable in the encoding the IDE wants must reach the IDE unchanged
+func TestUTF8RoundTrip(t *testing.T) {
+	tests := []struct {
+		input    string
+		encoding string
+	}{
+		{"plain ascii", encodingLatin1},
+		{"caf\xe9 na\xefve", encodingLatin1},
+		{"caf\xc3\xa9 \xe2\x82\xac", encodingUTF8},
+		{"\x00\x01\x7f\x80\xff", encodingLatin1},
+	}
+
+	for _, test := range tests {
+		actual := string(fromUTF8(toUTF8(test.input), test.encoding))
+		if actual != test.input {
+			t.Errorf("fromUTF8(toUTF8(%q), %v): expected %q, got %q", test.input, test.encoding, test.input, actual)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"strings"
+)
+
+const (
+	// See dontbug_error_location() in dontbug.c
+	dontbugErrorLocation = "dontbug_error_location"
+
+	// The E_* constants of PHP
+	phpErrorError            = 1
+	phpErrorWarning          = 2
+	phpErrorParse            = 4
+	phpErrorNotice           = 8
+	phpErrorCoreError        = 16
+	phpErrorCoreWarning      = 32
+	phpErrorCompileError     = 64
+	phpErrorCompileWarning   = 128
+	phpErrorUserError        = 256
+	phpErrorUserWarning      = 512
+	phpErrorUserNotice       = 1024
+	phpErrorStrict           = 2048
+	phpErrorRecoverableError = 4096
+	phpErrorDeprecated       = 8192
+	phpErrorUserDeprecated   = 16384
+)
+
+type phpErrorSeverity struct {
+	name string
+	mask int
+}
+
+// The names are the ones Xdebug uses (see xdebug_error_type()) so that an IDE can set an exception breakpoint
+// on "Warning", "Notice" etc. just like it would with Xdebug
+var gPhpErrorSeverities = []phpErrorSeverity{
+	{"Fatal error", phpErrorError | phpErrorCoreError | phpErrorCompileError | phpErrorUserError},
+	{"Recoverable fatal error", phpErrorRecoverableError},
+	{"Warning", phpErrorWarning | phpErrorCoreWarning | phpErrorCompileWarning | phpErrorUserWarning},
+	{"Parse error", phpErrorParse},
+	{"Notice", phpErrorNotice | phpErrorUserNotice},
+	{"Strict standards", phpErrorStrict},
+	{"Deprecated", phpErrorDeprecated | phpErrorUserDeprecated},
+}
+
+// Returns the severity for a name like "Warning" (case insensitive) and false if it is not the name of a severity
+func phpErrorSeverityByName(name string) (phpErrorSeverity, bool) {
+	for _, severity := range gPhpErrorSeverities {
+		if strings.EqualFold(severity.name, strings.TrimSpace(name)) {
+			return severity, true
+		}
+	}
+
+	return phpErrorSeverity{}, false
+}
+
+// errorType is an E_* constant
+func phpErrorSeverityName(errorType int) string {
+	for _, severity := range gPhpErrorSeverities {
+		if severity.mask&errorType != 0 {
+			return severity.name
+		}
+	}
+
+	return "Unknown error"
+}
+
+// An exception breakpoint on "Warning", "Notice" etc. breaks on PHP errors of that severity and not on exceptions
+func isErrorBreakpoint(bp *engineBreakPoint) bool {
+	if bp.bpType != breakpointTypeException {
+		return false
+	}
+
+	_, ok := phpErrorSeverityByName(bp.exception)
+	return ok
+}
+
+func atErrorBreakpoint(es *engineState) bool {
+	return atBreakpointInHookFunction(es) && isErrorBreakpoint(es.lastHitBreakpoint)
+}
+
+// gdb condition on dontbug_error_location() for the severity
+func phpErrorCondition(severity phpErrorSeverity) string {
+	return fmt.Sprintf("(type & %v) != 0", severity.mask)
+}
+
+// The severity and message of the PHP error we're stopped at. See dontbug_error_location() in dontbug.c
+func currentPhpError(es *engineState) (string, string) {
+	errorType := xSlashDgdb(es.gdbSession, "type")
+	message := toUTF8(xSlashSgdb(es.gdbSession, "message"))
+	return phpErrorSeverityName(errorType), message
+}
+
+// The <severity> of error <severity> on the dontbug prompt. Returns false (after telling the user) if there is
+// no such severity
+func parseErrorSeverityFromPrompt(name string) (phpErrorSeverity, bool) {
+	if strings.TrimSpace(name) == "" {
+		var names []string
+		for _, severity := range gPhpErrorSeverities {
+			names = append(names, severity.name)
+		}
+		color.Yellow("dontbug: Please specify one of: %v", strings.Join(names, ", "))
+		return phpErrorSeverity{}, false
+	}
+
+	severity, ok := phpErrorSeverityByName(name)
+	if !ok {
+		color.Red("dontbug: Unknown PHP error severity: %v", strings.TrimSpace(name))
+		return phpErrorSeverity{}, false
+	}
+
+	return severity, true
+}
+
+// error <severity> on the dontbug prompt. Same as the IDE setting an exception breakpoint on the severity
+func setErrorBreakpointFromPrompt(es *engineState, severity phpErrorSeverity) {
+	dCmd := dbgpCmd{
+		command:     "breakpoint_set",
+		fullCommand: "breakpoint_set (from the dontbug prompt)",
+		options:     map[string]string{"t": string(breakpointTypeException), "x": severity.name, "s": string(breakpointStateEnabled)},
+	}
+
+	// The IDE could be setting breakpoints of its own at the same time
+	runFromPrompt(es, false, func() {
+		// The breakpoint stays when a new IDE connects as the IDE doesn't know of it
+		response := setUnclaimedBreakpoints(es, []dbgpCmd{dCmd})[0]
+		if strings.Contains(response, "<error") {
+			color.Red("dontbug: Could not set breakpoint on PHP %v", severity.name)
+			return
+		}
+
+		updateSessionFromEngineState(es)
+		color.Green("dontbug: Will break on PHP %v (in either direction)", severity.name)
+	})
+}
@@ -0,0 +1,94 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// See dontbug_exception_location() in dontbug.c
+	dontbugExceptionLocation = "dontbug_exception_location"
+
+	// Matches any exception
+	exceptionWildcard = "*"
+)
+
+// -t exception -x ClassName or -t exception -x * for all exceptions
+// The breakpoint is hit at the throw site (whether the exception is caught or not) and also for subclasses of ClassName
+//
+// Like Xdebug, -x can also be the severity of a PHP error e.g. Warning or Notice. See error_breakpoints.go
+func handleBreakpointSetExceptionBreakpoint(es *engineState, dCmd dbgpCmd) string {
+	exception, ok := dCmd.options["x"]
+	if !ok || exception == "" {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Please provide the exception name option -x for the exception breakpoint")
+	}
+
+	status, disabled, temporary, err := parseBreakpointStatusAndTemporary(dCmd)
+	if err != nil {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, err.Error())
+	}
+
+	hitValue, hitCondition, _, err := parseHitCondition(dCmd)
+	if err != nil {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, err.Error())
+	}
+
+	response, ok := matchingBreakpointSetResponse(es, dCmd, gBreakpointSetXMLResponseFormat, &engineBreakPoint{
+		bpType:       breakpointTypeException,
+		exception:    exception,
+		state:        engineBreakpointState(status),
+		temporary:    temporary,
+		hitValue:     hitValue,
+		hitCondition: hitCondition,
+	})
+	if ok {
+		return response
+	}
+
+	// dontbug_exception_location() is called for the exception class and each of its ancestors
+	// The wildcard must only match once per exception thrown
+	hookFunction := dontbugExceptionLocation
+	condition := "depth == 0"
+	if severity, ok := phpErrorSeverityByName(exception); ok {
+		hookFunction = dontbugErrorLocation
+		condition = phpErrorCondition(severity)
+	} else if exception != exceptionWildcard {
+		classHash := djbx33a64(asciiToLower(strings.TrimPrefix(exception, "\\")))
+		condition = fmt.Sprintf("class_hash == %vUL", classHash)
+	}
+
+	gdbID, breakErr := setPhpHookBreakpointInGdb(es, hookFunction, condition, disabled, temporary)
+	if breakErr != nil {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, breakErr.code, breakErr.message)
+	}
+
+	id := nextPhpBreakpointID(es)
+	es.breakpoints[id] = &engineBreakPoint{
+		id:            id,
+		gdbID:         gdbID,
+		bpType:        breakpointTypeException,
+		exception:     exception,
+		state:         engineBreakpointState(status),
+		temporary:     temporary,
+		hitValue:      hitValue,
+		hitCondition:  hitCondition,
+		hookFunction:  hookFunction,
+		hookCondition: condition,
+	}
+
+	return fmt.Sprintf(gBreakpointSetXMLResponseFormat, dCmd.seqNum, status, id)
+}
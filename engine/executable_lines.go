@@ -0,0 +1,377 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Generated next to dontbug_break.c. See generateExecutableLinesFile()
+const executableLinesFilename = "dontbug_executable_lines.json"
+
+// The first token of a statement that is never a statement of its own for the PHP compiler
+// i.e. no ZEND_EXT_STMT opcode is emitted for it and so the dontbug statement handler never sees its line
+// Note that function and class declarations are statements (outside a class body) and so are use and namespace
+var gNonStatementKeywords = map[string]bool{
+	"else":       true,
+	"elseif":     true,
+	"catch":      true,
+	"finally":    true,
+	"case":       true,
+	"default":    true,
+	"endif":      true,
+	"endwhile":   true,
+	"endfor":     true,
+	"endforeach": true,
+	"endswitch":  true,
+	"enddeclare": true,
+}
+
+// Statements that can use the alternative syntax i.e. "if (...):" or have a label "case 1:"
+// The ":" starts a new statement for these
+var gColonStatementKeywords = map[string]bool{
+	"if":      true,
+	"else":    true,
+	"elseif":  true,
+	"for":     true,
+	"foreach": true,
+	"while":   true,
+	"switch":  true,
+	"declare": true,
+	"case":    true,
+	"default": true,
+}
+
+// Statements whose header "(...)" can be followed by a single statement without braces e.g. "if ($a) foo();"
+var gControlHeaderKeywords = map[string]bool{
+	"if":      true,
+	"elseif":  true,
+	"for":     true,
+	"foreach": true,
+	"while":   true,
+	"switch":  true,
+	"declare": true,
+}
+
+// These are followed straight away by the statement they control e.g. "else foo();" or "do foo(); while (...);"
+var gBodyKeywords = map[string]bool{
+	"else": true,
+	"do":   true,
+}
+
+// Returns the nearest line at or after phpLineno where a PHP statement starts. A line breakpoint can only ever be
+// hit on such a line. Returns phpLineno as is if there is no such line or we can't tell
+func nearestExecutableLine(es *engineState, phpFilename string, phpLineno int) int {
+	lines := es.executableLines[phpFilename]
+	i := sort.SearchInts(lines, phpLineno)
+	if i == len(lines) {
+		return phpLineno
+	}
+
+	return lines[i]
+}
+
+// The PHP sources can change after the recording. So the lines with PHP statements are worked out from the sources
+// as they were when dontbug_break.c was generated for the recording. See loadExecutableLines()
+func generateExecutableLinesFile(extDirAbsNoSymPath string, phpFilenames []string) {
+	executableLines := make(map[string][]int, len(phpFilenames))
+	for _, phpFilename := range phpFilenames {
+		source, err := ioutil.ReadFile(phpFilename)
+		fatalIf(err)
+
+		// Keyed like the source map. See constructBreakpointLocMap()
+		executableLines["file://"+phpFilename] = phpExecutableLines(string(source))
+	}
+
+	data, err := json.Marshal(executableLines)
+	fatalIf(err)
+
+	err = ioutil.WriteFile(path.Clean(extDirAbsNoSymPath+"/"+executableLinesFilename), data, os.FileMode(0644))
+	fatalIf(err)
+}
+
+// Breakpoints in files that are not in here are never moved. This includes all files if dontbug_break.c was
+// generated by an older version of dontbug
+func loadExecutableLines(extensionDir string) map[string][]int {
+	executableLines := make(map[string][]int)
+	data, err := ioutil.ReadFile(path.Clean(getAbsNoSymlinkPath(extensionDir) + "/" + executableLinesFilename))
+	if err != nil {
+		Verboseln("dontbug: Could not read", executableLinesFilename, "Line breakpoints will not be moved to lines with PHP statements")
+		return executableLines
+	}
+
+	err = json.Unmarshal(data, &executableLines)
+	fatalIf(err)
+
+	return executableLines
+}
+
+// Whether nearestExecutableLine() knows the lines with PHP statements in the file. Only then can we be sure that
+// a line breakpoint in the file is on a line that can be hit
+func hasExecutableLines(es *engineState, phpFilename string) bool {
+	return len(es.executableLines[phpFilename]) > 0
+}
+
+type phpTokenizer struct {
+	src  string
+	pos  int
+	line int
+}
+
+type phpBraceContext struct {
+	parens        int  // unclosed ( and [ within these braces
+	classBody     bool // members of a class are declarations and not statements
+	controlHeader bool // within the "(...)" of an if, while etc. See gControlHeaderKeywords
+}
+
+// Works out the lines of PHP source code on which statements start, much like the PHP compiler would emit
+// ZEND_EXT_STMT opcodes. This is deliberately not a full PHP parser: only strings, comments, brackets and
+// statement separators are understood. Comes in handy for lines that are blank, have comments, closing braces etc.
+func phpExecutableLines(source string) []int {
+	t := &phpTokenizer{src: source, line: 1}
+	executable := map[int]bool{}
+
+	stack := []phpBraceContext{{}}
+	inPhp := false
+	atStatementStart := true
+	statementKeyword := ""
+	statementHasClass := false
+	prevToken := ""
+
+	for t.pos < len(t.src) {
+		if !inPhp {
+			echo, ok := t.skipInlineHTML()
+			if !ok {
+				break
+			}
+
+			inPhp = true
+			atStatementStart = !echo
+			if echo {
+				executable[t.line] = true
+				statementKeyword = "echo"
+			}
+			continue
+		}
+
+		startLine := t.line
+		token, ok := t.next()
+		if !ok {
+			continue
+		}
+
+		if token == "?>" {
+			inPhp = false
+			atStatementStart = true
+			continue
+		}
+
+		ctx := &stack[len(stack)-1]
+		lowerToken := strings.ToLower(token)
+		switch token {
+		case "{", "}", ";", ")", "]", ",", ":":
+		default:
+			if atStatementStart {
+				atStatementStart = gBodyKeywords[lowerToken]
+				statementKeyword = lowerToken
+				statementHasClass = false
+				if !ctx.classBody && !gNonStatementKeywords[lowerToken] {
+					executable[startLine] = true
+				}
+			}
+		}
+
+		switch token {
+		case "{":
+			stack = append(stack, phpBraceContext{classBody: statementHasClass})
+			atStatementStart = true
+		case "}":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			atStatementStart = stack[len(stack)-1].parens == 0
+		case "(", "[":
+			if token == "(" && ctx.parens == 0 && gControlHeaderKeywords[statementKeyword] {
+				ctx.controlHeader = true
+			}
+			ctx.parens++
+		case ")", "]":
+			if ctx.parens > 0 {
+				ctx.parens--
+			}
+
+			// The statement controlled by the header (if it has no braces) starts right after it
+			if ctx.parens == 0 && ctx.controlHeader {
+				ctx.controlHeader = false
+				atStatementStart = true
+			}
+		case ";":
+			atStatementStart = ctx.parens == 0
+		case ":":
+			if ctx.parens == 0 && gColonStatementKeywords[statementKeyword] {
+				atStatementStart = true
+			}
+		default:
+			// Foo::class is just the name of the class
+			if (lowerToken == "class" || lowerToken == "interface" || lowerToken == "trait") && prevToken != "::" && prevToken != "->" {
+				statementHasClass = true
+			}
+		}
+
+		prevToken = token
+	}
+
+	var lines []int
+	for line := range executable {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+
+	return lines
+}
+
+// Skips to just after the next <?php or <?= open tag. Returns true if it was <?=
+// Returns false as the second value if there is no open tag
+func (t *phpTokenizer) skipInlineHTML() (bool, bool) {
+	for t.pos < len(t.src) {
+		if strings.HasPrefix(t.src[t.pos:], "<?=") {
+			t.pos += 3
+			return true, true
+		}
+
+		if len(t.src)-t.pos >= 5 && strings.ToLower(t.src[t.pos:t.pos+5]) == "<?php" {
+			t.pos += 5
+			return false, true
+		}
+
+		t.advance()
+	}
+
+	return false, false
+}
+
+func (t *phpTokenizer) advance() {
+	if t.src[t.pos] == '\n' {
+		t.line++
+	}
+	t.pos++
+}
+
+func (t *phpTokenizer) hasPrefix(prefix string) bool {
+	return strings.HasPrefix(t.src[t.pos:], prefix)
+}
+
+// Returns the next token. Returns false if there was only whitespace or a comment
+// Strings (including heredocs) are returned as a single token
+func (t *phpTokenizer) next() (string, bool) {
+	c := t.src[t.pos]
+	start := t.pos
+
+	switch {
+	case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		t.advance()
+		return "", false
+	case c == '#' || t.hasPrefix("//"):
+		// A single line comment ends at the end of the line or at a ?>
+		for t.pos < len(t.src) && t.src[t.pos] != '\n' && !t.hasPrefix("?>") {
+			t.pos++
+		}
+		return "", false
+	case t.hasPrefix("/*"):
+		t.pos += 2
+		for t.pos < len(t.src) && !t.hasPrefix("*/") {
+			t.advance()
+		}
+		t.pos += 2
+		return "", false
+	case t.hasPrefix("?>") || t.hasPrefix("::") || t.hasPrefix("->"):
+		t.pos += 2
+		return t.src[start:t.pos], true
+	case t.hasPrefix("<<<"):
+		t.skipHeredoc()
+		return "<<<", true
+	case c == '\'' || c == '"' || c == '`':
+		t.skipQuoted(c)
+		return string(c), true
+	case isPhpWordChar(c):
+		for t.pos < len(t.src) && isPhpWordChar(t.src[t.pos]) {
+			t.pos++
+		}
+		return t.src[start:t.pos], true
+	default:
+		t.pos++
+		return string(c), true
+	}
+}
+
+func (t *phpTokenizer) skipQuoted(quote byte) {
+	t.pos++
+	for t.pos < len(t.src) {
+		c := t.src[t.pos]
+		if c == '\\' && t.pos+1 < len(t.src) {
+			t.pos++
+		} else if c == quote {
+			t.pos++
+			return
+		}
+		t.advance()
+	}
+}
+
+// <<<ID, <<<"ID" or <<<'ID' (nowdoc) up to a line that starts with ID (possibly indented)
+func (t *phpTokenizer) skipHeredoc() {
+	t.pos += 3
+	for t.pos < len(t.src) && (t.src[t.pos] == ' ' || t.src[t.pos] == '\t') {
+		t.pos++
+	}
+
+	if t.pos < len(t.src) && (t.src[t.pos] == '"' || t.src[t.pos] == '\'') {
+		t.pos++
+	}
+
+	start := t.pos
+	for t.pos < len(t.src) && isPhpWordChar(t.src[t.pos]) {
+		t.pos++
+	}
+
+	id := t.src[start:t.pos]
+	if id == "" {
+		return
+	}
+
+	for t.pos < len(t.src) {
+		if t.src[t.pos] != '\n' {
+			t.advance()
+			continue
+		}
+
+		t.advance()
+		rest := strings.TrimLeft(t.src[t.pos:], " \t")
+		if strings.HasPrefix(rest, id) && (len(rest) == len(id) || !isPhpWordChar(rest[len(id)])) {
+			t.pos = len(t.src) - len(rest) + len(id)
+			return
+		}
+	}
+}
+
+func isPhpWordChar(c byte) bool {
+	return c == '_' || c == '$' || c == '\\' || c >= 0x80 ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,141 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPhpExecutableLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		expected []int
+	}{
+		{"statements", `<?php
+// comment
+$a = 1;
+
+/* multi
+   line */
+foo($a,
+    $b);
+`, []int{3, 7}},
+		{"brace-less bodies", `<?php
+if ($a)
+    foo();
+elseif ($b)
+    bar();
+else
+    baz();
+foreach ($xs as $x)
+    echo $x;
+while ($i--)
+    qux();
+for ($i = 0; $i < 3; $i++)
+    quux($i);
+`, []int{2, 3, 5, 7, 8, 9, 10, 11, 12, 13}},
+		{"nested brace-less bodies", `<?php
+if ($a) {
+    foo();
+} else if ($b)
+    if (count($c) > 0)
+        bar();
+`, []int{2, 3, 4, 5, 6}},
+		{"heredoc and nowdoc", `<?php
+$a = <<<EOT
+  not code;
+  if (x) {
+EOT;
+$b = <<<'NOW'
+}
+NOW;
+foo();
+`, []int{2, 6, 9}},
+		{"?> inside // comment", `<?php
+foo(); // ends here ?>
+<p>html; if (x) {</p>
+<?= $x ?>
+<?php
+bar(); # also here ?><?php baz();
+`, []int{2, 4, 6}},
+		{"closures inside call args", `<?php
+array_map(function ($x) {
+    return $x * 2;
+}, $xs);
+usort($xs, function ($a, $b) { return $a - $b; });
+$f = function () use ($y) {
+    if ($y)
+        return 1;
+};
+`, []int{2, 3, 5, 6, 7, 8}},
+		{"class bodies", `<?php
+class Foo extends Bar
+{
+    const X = 1;
+    public $y = [1,
+        2];
+    public function baz()
+    {
+        return self::X;
+    }
+}
+$c = Foo::class;
+echo "done";
+`, []int{2, 9, 12, 13}},
+		{"declarations", `<?php
+namespace App;
+
+use Foo\Bar;
+
+function helper($x)
+{
+    return $x;
+}
+
+abstract class Base
+{
+    abstract protected function run();
+}
+`, []int{2, 4, 6, 8, 11}},
+		{"alternative syntax", `<?php
+if ($a):
+    foo();
+elseif ($b):
+    bar();
+else:
+    baz();
+endif;
+foreach ($xs as $x):
+    echo $x;
+endforeach;
+switch ($a):
+    case 1:
+        one();
+        break;
+    default:
+        two();
+endswitch;
+`, []int{2, 3, 5, 7, 9, 10, 12, 14, 15, 17}},
+	}
+
+	for _, test := range tests {
+		actual := phpExecutableLines(test.source)
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("phpExecutableLines (%v): expected %v, got %v", test.name, test.expected, actual)
+		}
+	}
+}
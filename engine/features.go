@@ -19,6 +19,11 @@ import (
 	"strconv"
 )
 
+func init() {
+	registerDbgpCmdHandler("feature_set", handleFeatureSet)
+	registerDbgpCmdHandler("feature_get", handleFeatureGet)
+}
+
 type engineFeatureBool struct {
 	value    bool
 	readOnly bool
@@ -89,13 +94,13 @@ func initFeatureMap() map[string]engineFeatureValue {
 		"language_name":             &engineFeatureString{"PHP", true},
 		// @TODO should the exact version be ascertained?
 		"language_version":           &engineFeatureString{"7.0", true},
-		"encoding":                   &engineFeatureString{"ISO-8859-1", true},
+		"encoding":                   &engineFeatureString{encodingLatin1, false},
 		"protocol_version":           &engineFeatureInt{1, true},
-		"supports_async":             &engineFeatureBool{false, true},
+		"supports_async":             &engineFeatureBool{true, true},
 		"supports_reverse_debugging": &engineFeatureBool{true, true},
 		// @TODO implement full list eventually
 		// "breakpoint_types" : &FeatureString{"line call return exception conditional watch", true},
-		"breakpoint_types":    &engineFeatureString{"line", true},
+		"breakpoint_types":    &engineFeatureString{"line conditional call return exception watch", true},
 		"multiple_sessions":   &engineFeatureBool{false, false},
 		"max_children":        &engineFeatureInt{64, false},
 		"max_data":            &engineFeatureInt{2048, false},
@@ -125,7 +130,22 @@ func handleFeatureSet(es *engineState, dCmd dbgpCmd) string {
 		return fmt.Sprintf(gFeatureSetXMLResponseFormat, dCmd.seqNum, n, 0)
 	}
 
+	if n == "encoding" {
+		v, ok = normalizeDbgpEncoding(v)
+		if !ok {
+			return fmt.Sprintf(gFeatureSetXMLResponseFormat, dCmd.seqNum, n, 0)
+		}
+	}
+
 	featureVal.set(v)
+	if n == "encoding" {
+		setIdeEncoding(es, v)
+	}
+
+	if n == "notify_ok" {
+		notifyPreexistingBreakpointsToIde(es)
+	}
+
 	return fmt.Sprintf(gFeatureSetXMLResponseFormat, dCmd.seqNum, n, 1)
 }
 
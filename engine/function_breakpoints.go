@@ -0,0 +1,192 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"strings"
+)
+
+const (
+	// See dontbug_function_entry_location() and dontbug_function_return_location() in dontbug.c
+	dontbugFunctionEntryLocation  = "dontbug_function_entry_location"
+	dontbugFunctionReturnLocation = "dontbug_function_return_location"
+
+	// Name of the pseudo-variable that shows the return value in context_get at a return breakpoint
+	returnValuePropertyName = "$__RETURN_VALUE"
+)
+
+// -t call -m function or -t call -m Class::method (or -t call -a Class -m method)
+// -t return takes the same options
+func handleBreakpointSetFunctionBreakpoint(es *engineState, dCmd dbgpCmd, bpType engineBreakpointType) string {
+	function, ok := dCmd.options["m"]
+	if !ok || function == "" {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Please provide the function name option -m for the "+string(bpType)+" breakpoint")
+	}
+
+	class, ok := dCmd.options["a"]
+	if ok && class != "" {
+		function = class + "::" + function
+	}
+
+	status, disabled, temporary, err := parseBreakpointStatusAndTemporary(dCmd)
+	if err != nil {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, err.Error())
+	}
+
+	hitValue, hitCondition, _, err := parseHitCondition(dCmd)
+	if err != nil {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, err.Error())
+	}
+
+	response, ok := matchingBreakpointSetResponse(es, dCmd, gBreakpointSetXMLResponseFormat, &engineBreakPoint{
+		bpType:       bpType,
+		function:     function,
+		state:        engineBreakpointState(status),
+		temporary:    temporary,
+		hitValue:     hitValue,
+		hitCondition: hitCondition,
+	})
+	if ok {
+		return response
+	}
+
+	hookFunction := dontbugFunctionEntryLocation
+	if bpType == breakpointTypeReturn {
+		hookFunction = dontbugFunctionReturnLocation
+	}
+
+	functionHash, classHash := phpFunctionHashes(function)
+	condition := fmt.Sprintf("function_hash == %vUL && class_hash == %vUL", functionHash, classHash)
+	gdbID, breakErr := setPhpHookBreakpointInGdb(es, hookFunction, condition, disabled, temporary)
+	if breakErr != nil {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, breakErr.code, breakErr.message)
+	}
+
+	id := nextPhpBreakpointID(es)
+	es.breakpoints[id] = &engineBreakPoint{
+		id:            id,
+		gdbID:         gdbID,
+		bpType:        bpType,
+		function:      function,
+		state:         engineBreakpointState(status),
+		temporary:     temporary,
+		hitValue:      hitValue,
+		hitCondition:  hitCondition,
+		hookFunction:  hookFunction,
+		hookCondition: condition,
+	}
+
+	return fmt.Sprintf(gBreakpointSetXMLResponseFormat, dCmd.seqNum, status, id)
+}
+
+// PHP function and class names are case insensitive. The class hash is 0 for functions that are not methods
+// These need to match what dontbug_lowercase_hash() in php_dontbug.h computes
+func phpFunctionHashes(function string) (uint64, uint64) {
+	var classHash uint64
+	parts := strings.SplitN(function, "::", 2)
+	if len(parts) == 2 {
+		// The IDE may send a fully qualified class name with a leading \
+		classHash = djbx33a64(asciiToLower(strings.TrimPrefix(parts[0], "\\")))
+		function = parts[1]
+	}
+
+	return djbx33a64(asciiToLower(function)), classHash
+}
+
+// Same as zend_tolower_ascii() i.e. only A-Z are lower cased
+func asciiToLower(str string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + ('a' - 'A')
+		}
+		return r
+	}, str)
+}
+
+// Sets a gdb breakpoint on one of the dontbug_*_location() hook functions in the dontbug zend extension
+// Does not make an entry in breakpoints table. Returns the gdb breakpoint number
+func setPhpHookBreakpointInGdb(es *engineState, hookFunction string, condition string, disabled bool, temporary bool) (string, *engineBreakpointError) {
+	breakInsertAr := []string{
+		"-f",
+		"-c",
+		fmt.Sprintf("\"%v\"", condition),
+	}
+
+	if temporary {
+		breakInsertAr = append(breakInsertAr, "-t")
+	}
+
+	if disabled {
+		breakInsertAr = append(breakInsertAr, "-d")
+	}
+
+	breakInsertAr = append(breakInsertAr, hookFunction)
+
+	result := sendGdbCommand(es.gdbSession, "break-insert", breakInsertAr...)
+	if result["class"] != "done" {
+		warning := fmt.Sprintf("dontbug: Could not set breakpoint in gdb backend on %v. Something is probably wrong with breakpoint parameters", hookFunction)
+		color.Red(warning)
+		return "", &engineBreakpointError{breakpointErrorCodeCouldNotSet, warning}
+	}
+
+	payload := result["payload"].(map[string]interface{})
+	bkpt := payload["bkpt"].(map[string]interface{})
+	return bkpt["number"].(string), nil
+}
+
+func atReturnBreakpoint(es *engineState) bool {
+	return es.status == statusBreak && es.lastHitBreakpoint != nil && es.lastHitBreakpoint.bpType == breakpointTypeReturn
+}
+
+// When a return (or exception) breakpoint is hit we stay in the hook function instead of moving to the
+// master breakpoint location. For return breakpoints that would be in the caller, after the function has returned.
+// For exception breakpoints that could be in a catch block, far away from the throw site
+func atBreakpointInHookFunction(es *engineState) bool {
+	if es.status != statusBreak || es.lastHitBreakpoint == nil {
+		return false
+	}
+
+	bpType := es.lastHitBreakpoint.bpType
+	return bpType == breakpointTypeReturn || bpType == breakpointTypeException
+}
+
+// Same as any other context_get but at a return breakpoint, the local variables also include the return value
+func handleContextGet(es *engineState, dCmd dbgpCmd) string {
+	result := handleInDiversionSessionWithNoGdbBpts(es, dCmd)
+	if !atReturnBreakpoint(es) {
+		return result
+	}
+
+	// Only the locals (context 0) of the current stack frame (depth 0)
+	c := dCmd.options["c"]
+	d := dCmd.options["d"]
+	if (c != "" && c != "0") || (d != "" && d != "0") {
+		return result
+	}
+
+	var returnValueXML string
+	withAllGdbBreakpointsDisabled(es, func() {
+		returnValueXML = toUTF8(xSlashSgdb(es.gdbSession, fmt.Sprintf("dontbug_return_value_xml(\"%v\")", gdbCStringEscape(returnValuePropertyName))))
+	})
+
+	end := strings.LastIndex(result, "</response>")
+	if returnValueXML == "" || end == -1 {
+		return result
+	}
+
+	return result[:end] + returnValueXML + result[end:]
+}
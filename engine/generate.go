@@ -48,14 +48,14 @@ var gBreakCskeletonHeader = `
 
 /**
  * This file was autogenerated by dontbug on ` + time.Now().String() + `
- * IMPORTANT -- DO NOT remove/edit/move comments with ### or $$$ or &&&
+ * IMPORTANT -- DO NOT remove/edit/move comments with ### or $$$ or &&& or %%%
  */
 #include "php.h"
 #include "php_dontbug.h"
 
 void dontbug_break_location(zend_string* zfilename, zend_execute_data *execute_data, int lineno, unsigned long level) {
     zend_ulong hash = zfilename->h;
-    char *filename = ZSTR_VAL(zfilename);
+    char *filename = ZSTR_VAL(zfilename); //%%% Fallback location for PHP files not found below
 `
 
 var gBreakCskeletonFooter = `
@@ -179,6 +179,12 @@ func generateBreakFile(rootDirAbsNoSymPath, extDirAbsNoSymPath, skelHeader, skel
 	fmt.Fprintln(f, generateLocBody(maxStackDepth))
 	fmt.Fprintln(f, skelLocFooter)
 
+	var phpFilenames []string
+	for _, hash := range ar {
+		phpFilenames = append(phpFilenames, m[hash]...)
+	}
+	generateExecutableLinesFile(extDirAbsNoSymPath, phpFilenames)
+
 	color.Green("dontbug: Code generation complete. Compiling dontbug zend extension...")
 }
 
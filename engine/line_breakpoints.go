@@ -0,0 +1,225 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// All the line breakpoints of a PHP file share one gdb breakpoint on the line for that file in dontbug_break.c
+// Its condition is something like "lineno == 10 || lineno == 25". So a statement in a file with many breakpoints
+// costs one condition evaluation in gdb instead of one for every breakpoint
+type engineFileBreakpoint struct {
+	gdbID     string
+	condition string // condition currently set in gdb
+	enabled   bool   // whether the gdb breakpoint is enabled currently
+}
+
+// Like Xdebug, PHP breakpoint ids are pid * 10000 + n. This way they're never mistaken for gdb breakpoint numbers
+func nextPhpBreakpointID(es *engineState) string {
+	es.breakpointCount++
+	return strconv.Itoa(os.Getpid()*10000 + es.breakpointCount)
+}
+
+// Brings the gdb breakpoint for phpFilename in line with the enabled line breakpoints of the file in es.breakpoints
+// The gdb breakpoint is created when the file gets its first breakpoint and disabled when it has none enabled
+func syncFileGdbBreakpoint(es *engineState, phpFilename string) *engineBreakpointError {
+	condition := fileBreakpointCondition(es, phpFilename)
+
+	fb, ok := es.fileBreakpoints[phpFilename]
+	if !ok {
+		if condition == "" {
+			return nil
+		}
+
+		id, breakErr := insertFileGdbBreakpoint(es, phpFilename, condition)
+		if breakErr != nil {
+			return breakErr
+		}
+
+		es.fileBreakpoints[phpFilename] = &engineFileBreakpoint{gdbID: id, condition: condition, enabled: true}
+		return nil
+	}
+
+	if condition == "" {
+		if fb.enabled {
+			sendGdbCommand(es.gdbSession, "break-disable", fb.gdbID)
+			fb.enabled = false
+		}
+		return nil
+	}
+
+	if condition != fb.condition {
+		sendGdbCommand(es.gdbSession, "break-condition", fb.gdbID, fmt.Sprintf("\"%v\"", gdbCStringEscape(condition)))
+		fb.condition = condition
+	}
+
+	if !fb.enabled {
+		sendGdbCommand(es.gdbSession, "break-enable", fb.gdbID)
+		fb.enabled = true
+	}
+
+	return nil
+}
+
+// Syncs the gdb breakpoints of the files of any line breakpoints in bpList
+func syncFileGdbBreakpointsFor(es *engineState, bpList []string) {
+	synced := map[string]bool{}
+	for _, id := range bpList {
+		bp, ok := es.breakpoints[id]
+		if ok && isLineBreakpoint(bp) && !synced[bp.filename] {
+			syncFileGdbBreakpoint(es, bp.filename)
+			synced[bp.filename] = true
+		}
+	}
+}
+
+func syncAllFileGdbBreakpoints(es *engineState) {
+	for phpFilename := range es.fileBreakpoints {
+		syncFileGdbBreakpoint(es, phpFilename)
+	}
+}
+
+// Returns "" if the file does not have any enabled line breakpoints
+func fileBreakpointCondition(es *engineState, phpFilename string) string {
+	linenos := map[int]bool{}
+	for _, bp := range es.breakpoints {
+		if isLineBreakpoint(bp) && bp.filename == phpFilename && bp.state == breakpointStateEnabled {
+			linenos[bp.lineno] = true
+		}
+	}
+
+	return linesBreakpointCondition(es, phpFilename, linenos)
+}
+
+// The gdb breakpoint condition for the file to break on any of linenos. Returns "" if linenos is empty
+func linesBreakpointCondition(es *engineState, phpFilename string, linenos map[int]bool) string {
+	var sorted []int
+	for lineno := range linenos {
+		sorted = append(sorted, lineno)
+	}
+	sort.Ints(sorted)
+
+	var terms []string
+	for _, lineno := range sorted {
+		terms = append(terms, fmt.Sprintf("lineno == %v", lineno))
+	}
+
+	if len(terms) == 0 {
+		return ""
+	}
+
+	condition := strings.Join(terms, " || ")
+	if !isInSourceMap(es, phpFilename) {
+		// The fallback location is shared by all such files. The line numbers are compared first as that is cheaper
+		condition = fmt.Sprintf("(%v) && $_streq((char *) zfilename->val, \"%v\")", condition, gdbCStringEscape(strings.TrimPrefix(phpFilename, "file://")))
+	}
+
+	return condition
+}
+
+func isInSourceMap(es *engineState, phpFilename string) bool {
+	_, ok := es.sourceMap[phpFilename]
+	return ok
+}
+
+// Callers make sure the file is either in the source map or that there is a fallback location
+func insertFileGdbBreakpoint(es *engineState, phpFilename string, condition string) (string, *engineBreakpointError) {
+	internalLineno, ok := es.sourceMap[phpFilename]
+	if !ok {
+		internalLineno = es.fallbackBreakLine
+	}
+
+	breakInsertAr := []string{
+		"-f",
+		"-c",
+		fmt.Sprintf("\"%v\"", gdbCStringEscape(condition)),
+		"--source",
+		"dontbug_break.c",
+		"--line",
+		strconv.Itoa(internalLineno),
+	}
+
+	result := sendGdbCommand(es.gdbSession, "break-insert", breakInsertAr...)
+	if result["class"] != "done" {
+		warning := fmt.Sprintf("dontbug: Could not set breakpoint in gdb backend for %v. Something is probably wrong with breakpoint parameters", phpFilename)
+		color.Red(warning)
+		return "", &engineBreakpointError{breakpointErrorCodeCouldNotSet, warning}
+	}
+
+	payload := result["payload"].(map[string]interface{})
+	bkpt := payload["bkpt"].(map[string]interface{})
+	return bkpt["number"].(string), nil
+}
+
+func isLineBreakpoint(bp *engineBreakPoint) bool {
+	return bp.bpType == breakpointTypeLine || bp.bpType == breakpointTypeConditional
+}
+
+// Returns the PHP file whose line breakpoints are behind the gdb breakpoint gdbID, if any
+func fileForGdbBreakpoint(es *engineState, gdbID string) (string, bool) {
+	for phpFilename, fb := range es.fileBreakpoints {
+		if fb.gdbID == gdbID {
+			return phpFilename, true
+		}
+	}
+
+	return "", false
+}
+
+func enabledLineBreakpointsAt(es *engineState, phpFilename string, phpLineno int) []string {
+	var bps []*engineBreakPoint
+	for _, bp := range es.breakpoints {
+		if isLineBreakpoint(bp) && bp.filename == phpFilename && bp.lineno == phpLineno && bp.state == breakpointStateEnabled {
+			bps = append(bps, bp)
+		}
+	}
+	sort.Sort(breakpointsByID(bps))
+
+	var ids []string
+	for _, bp := range bps {
+		ids = append(ids, bp.id)
+	}
+
+	return ids
+}
+
+// Works out the PHP breakpoint a gdb stop is for. Returns true if the stop should be skipped silently
+//
+// A stop on the gdb breakpoint of a file could be for more than one PHP breakpoint e.g. a line breakpoint and a
+// conditional breakpoint on the same line. Each of them is counted as hit (if its condition holds) but the stop
+// is reported as being for the first one. See shouldSkipBreakpointHit()
+func phpBreakpointForGdbStop(es *engineState, gdbID string) (string, bool) {
+	phpFilename, ok := fileForGdbBreakpoint(es, gdbID)
+	if !ok {
+		id := phpBreakpointIDForGdbID(es, gdbID)
+		return id, shouldSkipBreakpointHit(es, id)
+	}
+
+	phpLineno := xSlashDgdb(es.gdbSession, "lineno")
+	hitID := ""
+	for _, id := range enabledLineBreakpointsAt(es, phpFilename, phpLineno) {
+		if !shouldSkipBreakpointHit(es, id) && hitID == "" {
+			hitID = id
+		}
+	}
+
+	return hitID, hitID == ""
+}
@@ -0,0 +1,57 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"testing"
+)
+
+func TestFileBreakpointCondition(t *testing.T) {
+	const inMap = "file:///var/www/index.php"
+	const notInMap = "file:///usr/share/php/Lib \"x\".php"
+
+	es := &engineState{
+		sourceMap: map[string]int{inMap: 20},
+		breakpoints: map[string]*engineBreakPoint{
+			"1":     {id: "1", bpType: breakpointTypeInternal, filename: "dontbug.c", lineno: 114, state: breakpointStateDisabled},
+			"10001": {id: "10001", bpType: breakpointTypeLine, filename: inMap, lineno: 12, state: breakpointStateEnabled},
+			"10002": {id: "10002", bpType: breakpointTypeConditional, filename: inMap, lineno: 3, state: breakpointStateEnabled},
+			"10003": {id: "10003", bpType: breakpointTypeLine, filename: inMap, lineno: 12, state: breakpointStateEnabled},
+			"10004": {id: "10004", bpType: breakpointTypeLine, filename: inMap, lineno: 40, state: breakpointStateDisabled},
+			"10005": {id: "10005", bpType: breakpointTypeCall, filename: inMap, lineno: 7, state: breakpointStateEnabled},
+			"10006": {id: "10006", bpType: breakpointTypeLine, filename: notInMap, lineno: 5, state: breakpointStateEnabled},
+			"10007": {id: "10007", bpType: breakpointTypeLine, filename: "file:///var/www/disabled.php", lineno: 5, state: breakpointStateDisabled},
+		},
+	}
+
+	tests := []struct {
+		filename string
+		expected string
+	}{
+		// Sorted and without duplicates. Disabled breakpoints and other breakpoint types don't count
+		{inMap, "lineno == 3 || lineno == 12"},
+		// The fallback location is shared by all files not in the source map so the filename is checked as well
+		{notInMap, `(lineno == 5) && $_streq((char *) zfilename->val, "/usr/share/php/Lib \"x\".php")`},
+		{"file:///var/www/disabled.php", ""},
+		{"file:///var/www/none.php", ""},
+	}
+
+	for _, test := range tests {
+		actual := fileBreakpointCondition(es, test.filename)
+		if actual != test.expected {
+			t.Errorf("fileBreakpointCondition(%v): expected %q, got %q", test.filename, test.expected, actual)
+		}
+	}
+}
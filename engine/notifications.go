@@ -0,0 +1,92 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// dontbug specific notifications. These are in the dontbug namespace
+const (
+	notifyDirectionChanged = "direction_changed"
+	notifyRequestChanged   = "request_changed"
+)
+
+// The IDE needs to opt into notifications via feature_set -n notify_ok -v 1
+func notificationsEnabled(es *engineState) bool {
+	notifyOk, ok := es.featureMap["notify_ok"].(*engineFeatureInt)
+	return ok && notifyOk.value == 1
+}
+
+func sendNotification(es *engineState, payload string) {
+	if !notificationsEnabled(es) {
+		return
+	}
+
+	sendToIde(es, payload)
+}
+
+// Sent after a line breakpoint has been mapped to a location in dontbug_break.c
+func notifyBreakpointResolvedToIde(es *engineState, bp *engineBreakPoint) {
+	payload := fmt.Sprintf(gBreakpointResolvedNotifyXMLFormat, bp.id, bp.bpType, xmlAttrEscape(bp.filename), bp.lineno, bp.state)
+	sendNotification(es, payload)
+}
+
+// A new IDE knows nothing of the breakpoints we already had when it connected e.g. the ones restored from a saved
+// session. They're announced once the IDE asks for notifications. See resetEngineStateForNewIde()
+func notifyPreexistingBreakpointsToIde(es *engineState) {
+	if !notificationsEnabled(es) {
+		return
+	}
+
+	for _, id := range es.preexistingBreakpoints {
+		bp, ok := es.breakpoints[id]
+		if ok {
+			sendNotification(es, fmt.Sprintf(gBreakpointFullResolvedNotifyXMLFormat, breakpointXML(es, bp)))
+		}
+	}
+
+	es.preexistingBreakpoints = nil
+}
+
+// Sent when the user toggles between forward and reverse mode at the dontbug prompt
+func notifyDirectionChangedToIde(es *engineState, reverse bool) {
+	direction := "forward"
+	if reverse {
+		direction = "reverse"
+	}
+
+	attrs := fmt.Sprintf(` dontbug:direction="%v"`, direction)
+	payload := fmt.Sprintf(gDontbugNotifyXMLFormat, dontbugXMLNamespace, notifyDirectionChanged, attrs)
+	sendNotification(es, payload)
+}
+
+// PHP increments dontbug_request_num at the start of every request (see PHP_RINIT_FUNCTION in dontbug.c)
+// If it differs from what we saw at the last stop, we have crossed a web request boundary
+func notifyIfRequestChanged(es *engineState) {
+	requestNum, err := strconv.Atoi(xGdbCmdValue(es.gdbSession, "dontbug_request_num"))
+	panicIf(err)
+
+	if requestNum == es.requestNum {
+		return
+	}
+
+	attrs := fmt.Sprintf(` dontbug:from="%v" dontbug:to="%v"`, es.requestNum, requestNum)
+	es.requestNum = requestNum
+
+	payload := fmt.Sprintf(gDontbugNotifyXMLFormat, dontbugXMLNamespace, notifyRequestChanged, attrs)
+	sendNotification(es, payload)
+}
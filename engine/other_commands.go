@@ -16,30 +16,57 @@ package engine
 
 import (
 	"fmt"
+	"github.com/fatih/color"
 )
 
+func init() {
+	registerDbgpCmdHandler("status", handleStatus)
+	registerDbgpCmdHandler("break", handleBreak)
+	registerDbgpCmdHandler("run", handleRun)
+	registerDbgpCmdHandler("stop", handleStop)
+	registerDbgpCmdHandler("property_set", handlePropertySet)
+
+	// These commands could trigger breakpoints in gdb when run in the diversion session
+	registerDbgpCmdHandler("eval", handleInDiversionSessionWithNoGdbBpts)
+	registerDbgpCmdHandler("property_get", handleInDiversionSessionWithNoGdbBpts)
+	registerDbgpCmdHandler("context_get", handleContextGet)
+
+	registerDbgpCmdHandler("stack_get", handleInDiversionSessionStandard)
+	registerDbgpCmdHandler("stack_depth", handleInDiversionSessionStandard)
+	registerDbgpCmdHandler("context_names", handleInDiversionSessionStandard)
+	registerDbgpCmdHandler("typemap_get", handleInDiversionSessionStandard)
+	registerDbgpCmdHandler("source", handleInDiversionSessionStandard)
+	registerDbgpCmdHandler("property_value", handleInDiversionSessionStandard)
+}
+
 // rr replay sessions are read-only so property_set will always fail
 func handlePropertySet(es *engineState, dCmd dbgpCmd) string {
 	return fmt.Sprintf(gPropertySetXMLResponseFormat, dCmd.seqNum)
 }
 
-// @TODO The stdout/stdin/stderr commands always returns attribute success = "0" until this is implemented
-func handleStdFd(es *engineState, dCmd dbgpCmd, fdName string) string {
-	return fmt.Sprintf(gStdFdXMLResponseFormat, dCmd.seqNum, fdName)
-}
-
 func handleStop(es *engineState, dCmd dbgpCmd) string {
+	color.Yellow("IDE sent 'stop' command")
+	es.statusBeforeStop = es.status
 	es.status = statusStopped
 	return fmt.Sprintf(gStatusXMLResponseFormat, dCmd.seqNum, es.status, es.reason)
 }
 
 func handleInDiversionSessionStandard(es *engineState, dCmd dbgpCmd) string {
+	if es.status == statusStopping {
+		return traceEndNotAvailableResponse(dCmd)
+	}
+
 	return diversionSessionCmd(es, dCmd.fullCommand)
 }
 
+// The PHP program has finished at the end of the trace so there is nothing to inspect
+func traceEndNotAvailableResponse(dCmd dbgpCmd) string {
+	return fmt.Sprintf(gErrorXMLResponseFormat, dCmd.command, dCmd.seqNum, dbgpErrorCodeNotAvailable, "Not available at the end of the trace. Run or step in reverse mode to go back")
+}
+
 func diversionSessionCmd(es *engineState, command string) string {
-	result := xSlashSgdb(es.gdbSession, fmt.Sprintf("dontbug_xdebug_cmd(\"%v\")", command))
-	return result
+	result := xSlashSgdb(es.gdbSession, fmt.Sprintf("dontbug_xdebug_cmd(\"%v\")", gdbCStringEscape(command)))
+	return toUTF8(result)
 }
 
 func recoverableDiversionSessionCmd(es *engineState, command string) string {
@@ -55,25 +82,41 @@ func recoverableDiversionSessionCmd(es *engineState, command string) string {
 }
 
 func handleInDiversionSessionWithNoGdbBpts(es *engineState, dCmd dbgpCmd) string {
+	if es.status == statusStopping {
+		return traceEndNotAvailableResponse(dCmd)
+	}
+
 	bpList := getEnabledPhpBreakpoints(es)
 	disableAllGdbBreakpoints(es)
 	result := diversionSessionCmd(es, dCmd.fullCommand)
 	enableGdbBreakpoints(es, bpList)
+	if es.stdFdBpID != "" {
+		sendGdbCommand(es.gdbSession, "break-enable", es.stdFdBpID)
+	}
 	return result
 }
 
 func handleRun(es *engineState, dCmd dbgpCmd) string {
+	if es.status == statusStopping && !dCmd.reverse {
+		return traceEndResponse(es, "run", dCmd.seqNum)
+	}
+
 	// Don't hit a breakpoint on your (own) line
 	if dCmd.reverse {
-		bpList := getEnabledPhpBreakpoints(es)
-		disableGdbBreakpoints(es, bpList)
 		// Kind of a step_into backwards
-		gotoMasterBpLocation(es, true)
-		enableGdbBreakpoints(es, bpList)
+		id, _ := gotoMasterBpLocationWithNoPhpBpts(es, true)
+		if id == stopIDTraceStart {
+			gotoMasterBpLocationWithNoPhpBpts(es, false)
+			return phpBreakResponse(es, "run", dCmd.seqNum)
+		}
 	}
 
 	// Resume execution, either forwards or backwards
-	_, userBreakPointHit := continueExecution(es, dCmd.reverse)
+	stopID, userBreakPointHit := continueExecution(es, dCmd.reverse)
+
+	if userBreakPointHit && stayAtBreakpointHit(es) {
+		return phpBreakResponse(es, "run", dCmd.seqNum)
+	}
 
 	if userBreakPointHit {
 		bpList := getEnabledPhpBreakpoints(es)
@@ -91,18 +134,41 @@ func handleRun(es *engineState, dCmd dbgpCmd) string {
 			gotoMasterBpLocation(es, false)
 		}
 
-		filename := xSlashSgdb(es.gdbSession, "filename")
-		phpLineno := xSlashDgdb(es.gdbSession, "lineno")
-
+		response := phpBreakResponse(es, "run", dCmd.seqNum)
 		enableGdbBreakpoints(es, bpList)
 
-		return fmt.Sprintf(gRunOrStepBreakXMLResponseFormat, "run", dCmd.seqNum, filename, phpLineno)
+		return response
+	}
+
+	if stopID == stopIDInterrupted {
+		return interruptedResponse(es, "run", dCmd.seqNum, dCmd.reverse)
 	}
 
-	panicWith("Unimplemented program end handling")
+	if stopID == stopIDTraceEnd {
+		return traceEndResponse(es, "run", dCmd.seqNum)
+	}
+
+	if stopID == stopIDTraceStart {
+		// Settle on the first PHP statement in the trace
+		gotoMasterBpLocationWithNoPhpBpts(es, false)
+		return phpBreakResponse(es, "run", dCmd.seqNum)
+	}
+
+	panicWith("Unexpected gdb stop while running: " + stopID)
 	return ""
 }
 
+// The IDE sends this (asynchronously) to interrupt a run/step in progress
+// The run/step command itself will then respond with the PHP statement we stopped at
+func handleBreak(es *engineState, dCmd dbgpCmd) string {
+	if interruptExecution(es) {
+		color.Yellow("dontbug: IDE sent 'break' command. Will stop at the nearest PHP statement")
+		return fmt.Sprintf(gBreakXMLResponseFormat, dCmd.seqNum, 1)
+	}
+
+	return fmt.Sprintf(gBreakXMLResponseFormat, dCmd.seqNum, 0)
+}
+
 func handleStatus(es *engineState, dCmd dbgpCmd) string {
 	return fmt.Sprintf(gStatusXMLResponseFormat, dCmd.seqNum, es.status, es.reason)
 }
@@ -31,6 +31,7 @@ import (
 	"os/user"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -38,10 +39,14 @@ import (
 )
 
 const (
+	ideDialInitialBackoff = 500 * time.Millisecond
+	ideDialMaxBackoff     = 10 * time.Second
+
 	numFilesSentinel      = "//&&& Number of Files:"
 	maxStackDepthSentinel = "//&&& Max Stack Depth:"
 	phpFilenameSentinel   = "//###"
 	levelSentinel         = "//$$$"
+	fallbackSentinel      = "//%%%"
 
 	// @TODO improve this
 	gHelpText = `
@@ -50,8 +55,25 @@ q        quit
 r        debug in reverse mode
 f        debug in forward (normal) mode
 t        toggle between reverse and forward modes
+Ctrl-C   interrupt a run/step in progress (same as the break button in your IDE)
 v        toggle between verbose and quiet modes
 n        toggle between showing and not showing gdb notifications
+error <kind>
+         break on PHP errors of this kind (forward or reverse) e.g. error Warning
+         Kinds: Fatal error, Recoverable fatal error, Warning, Parse error, Notice, Strict standards, Deprecated
+request  tell you which (web) request you are in, along with its method and URI
+request next | previous | <number>
+         go to the first PHP statement of the next/previous request or request <number>. Also: request n, request p
+event <number>
+         go to rr event <number> and then on to the next PHP statement. Without <number>, tell you the current event
+tick <number>
+         go to rr tick <number> and then on to the next PHP statement. Without <number>, tell you the current tick
+mark <name>
+         bookmark the current PHP statement as <name> (an rr checkpoint is created for it)
+goto <name>
+         go to the bookmark <name> straight away, without having to run there
+marks    list the bookmarks
+connect  connect to the IDE again after it stopped the debugging session
 <enter>  will tell you whether you are in forward or reverse mode
 
 Debugging in reverse mode can be confusing but here is a cheat sheet:
@@ -145,9 +167,13 @@ func getSnapInfoFromUser() (snapInfo, bool) {
 	}
 }
 
-func DoReplay(installLocation, replayArg, rrPath, gdbPath string, replayHost string, replayPort int, targetExtendedRemotePort int) {
+func DoReplay(installLocation, replayArg, rrPath, gdbPath string, replayHost string, replayPort int, listen bool, ideKey string, dbgpProxy string, targetExtendedRemotePort int) {
+	if listen && dbgpProxy != "" {
+		log.Fatal("dontbug: --listen and --dbgp-proxy cannot be used together. A DBGp proxy always needs to be connected to")
+	}
+
 	extAbsNoSymDir := getAbsNoSymExtDirAndCheckInstallLocation(installLocation)
-	bpMap, levelAr, maxStackDepth := constructBreakpointLocMap(extAbsNoSymDir)
+	bpMap, levelAr, maxStackDepth, fallbackLine := constructBreakpointLocMap(extAbsNoSymDir)
 
 	rrTraceDir := "" // This corresponds to the latest trace
 	snapInfo := snapInfo{}
@@ -174,7 +200,22 @@ func DoReplay(installLocation, replayArg, rrPath, gdbPath string, replayHost str
 		maxStackDepth,
 		targetExtendedRemotePort,
 	)
-	debuggerLoop(engineState, replayHost, replayPort)
+	engineState.ideKey = ideKey
+	engineState.fallbackBreakLine = fallbackLine
+	engineState.executableLines = loadExecutableLines(extAbsNoSymDir)
+
+	reverse := false
+	engineState.traceDir = getRRTraceDir(rrTraceDir)
+	if engineState.traceDir != "" {
+		session, ok := loadSession(engineState.traceDir)
+		if ok && askUserToRestoreSession(session) {
+			restoreSession(engineState, session)
+			reverse = session.Reverse
+		}
+	}
+
+	recordRRPosition(engineState)
+	debuggerLoop(engineState, reverse, replayHost, replayPort, listen, dbgpProxy)
 }
 
 func startReplayInRR(traceDir string, rrPath, gdbPath string, bpMap map[string]int, levelAr []int, maxStackDepth int, targetExtendedRemotePort int) *engineState {
@@ -246,6 +287,8 @@ func startGdbAndInitDebugEngineState(gdbExecutable string, hardlinkFile string,
 	gdbArgs := []string{
 		gdbExecutable,
 		"-l", "-1",
+		// So that we can send an -exec-interrupt while gdb is running the program
+		"-ex", "set mi-async on",
 		"-ex", fmt.Sprintf("target extended-remote :%v", targetExtendedRemotePort),
 		"--interpreter", "mi",
 		hardlinkFile,
@@ -258,6 +301,7 @@ func startGdbAndInitDebugEngineState(gdbExecutable string, hardlinkFile string,
 
 	stopEventChan := make(chan string)
 	started := false
+	console := &gdbConsoleCapture{}
 
 	gdbSession, err = gdb.NewCmd(gdbArgs,
 		func(notification map[string]interface{}) {
@@ -267,6 +311,10 @@ func startGdbAndInitDebugEngineState(gdbExecutable string, hardlinkFile string,
 				fmt.Println(string(jsonResult))
 			}
 
+			if console.capture(notification) {
+				return
+			}
+
 			id, ok := breakpointStopGetID(notification)
 			if ok {
 				// Don't send the very first stopped notification
@@ -275,6 +323,18 @@ func startGdbAndInitDebugEngineState(gdbExecutable string, hardlinkFile string,
 				}
 
 				started = true
+				return
+			}
+
+			id, ok = traceBoundaryStopGetID(notification)
+			if ok && started {
+				stopEventChan <- id
+				return
+			}
+
+			// Any other stop e.g. due to an -exec-interrupt
+			if isStoppedNotification(notification) && started {
+				stopEventChan <- stopIDInterrupted
 			}
 		})
 
@@ -301,6 +361,7 @@ func startGdbAndInitDebugEngineState(gdbExecutable string, hardlinkFile string,
 	filename := payload["value"].(string)
 	properFilename, err := parseGdbStringResponse(filename)
 	fatalIf(err)
+	properFilename = toUTF8(properFilename)
 
 	es := &engineState{
 		gdbSession:      gdbSession,
@@ -315,9 +376,19 @@ func startGdbAndInitDebugEngineState(gdbExecutable string, hardlinkFile string,
 		rrCmd:           rrCmd,
 		maxStackDepth:   maxStackDepth,
 		breakpoints:     make(map[string]*engineBreakPoint, 10),
+		fileBreakpoints: make(map[string]*engineFileBreakpoint),
+		executableLines: make(map[string][]int),
+		bookmarks:       make(map[string]*engineBookmark),
+		engineLock:      make(chan struct{}, 1),
+		reconnectIde:    make(chan struct{}),
 		rrFile:          rrFile,
+		stdFdModes:      map[string]int{"stdout": 0, "stderr": 0},
+		gdbConsole:      console,
 	}
 
+	es.requestNum, err = strconv.Atoi(xGdbCmdValue(gdbSession, "dontbug_request_num"))
+	fatalIf(err)
+
 	// "1" is always the first breakpoint number in gdb
 	// Its used for stepping
 	es.breakpoints["1"] = &engineBreakPoint{
@@ -332,7 +403,7 @@ func startGdbAndInitDebugEngineState(gdbExecutable string, hardlinkFile string,
 	return es
 }
 
-func debuggerLoop(es *engineState, replayHost string, replayPort int) {
+func debuggerLoop(es *engineState, reverse bool, replayHost string, replayPort int, listen bool, dbgpProxy string) {
 	defer func() {
 		es.rrFile.Close()
 		err := es.rrCmd.Wait()
@@ -340,65 +411,83 @@ func debuggerLoop(es *engineState, replayHost string, replayPort int) {
 	}()
 	defer es.gdbSession.Exit()
 
-	reverse := false
 	mutex := &sync.Mutex{}
-	closeConChan := make(chan bool, 1)
+	quitChan := make(chan bool, 1)
 	defer func() {
-		closeConChan <- true
+		quitChan <- true
 	}()
-	go debuggerIdeLoop(es, closeConChan, mutex, &reverse, replayHost, replayPort)
 
-	fmt.Print("(dontbug) ") // prompt
 	currentUser, err := user.Current()
 	fatalIf(err)
 
 	historyFile := currentUser.HomeDir + "/.dontbug.history"
 	rdline, err := readline.NewEx(
 		&readline.Config{
-			Prompt:      "(dontbug) ",
+			Prompt:      promptString(es),
 			HistoryFile: historyFile,
 		})
 
 	fatalIf(err)
 	defer rdline.Close()
 
+	// The prompt shows the rr position of the last stop. See recordRRPosition()
+	es.prompt = rdline
+	fmt.Print(promptString(es)) // prompt
+	go debuggerIdeLoop(es, quitChan, mutex, &reverse, replayHost, replayPort, listen, dbgpProxy)
+
 	color.Yellow("h <enter> for help. If the prompt does not display press <enter>")
 	for {
 		userResponse, err := rdline.Readline()
-		if err == io.EOF || err == readline.ErrInterrupt {
+		if err == readline.ErrInterrupt && interruptExecution(es) {
+			color.Yellow("dontbug: Interrupting. Will stop at the nearest PHP statement")
+			continue
+		} else if err == io.EOF || err == readline.ErrInterrupt {
 			color.Yellow("Exiting.")
 			return
 		} else if err != nil {
 			log.Fatal(err)
 		}
 
-		if strings.HasPrefix(userResponse, "t") {
-			mutex.Lock()
-			reverse = !reverse
-			mutex.Unlock()
-			if reverse {
-				color.Red("In reverse mode")
-			} else {
-				color.Green("In forward mode")
+		// Commands that are words need to be matched before the single letter commands below
+		if strings.HasPrefix(userResponse, "request") {
+			handleRequestPromptCmd(es, userResponse[len("request"):])
+		} else if strings.HasPrefix(userResponse, "event") {
+			handleSeekPromptCmd(es, true, userResponse[len("event"):])
+		} else if strings.HasPrefix(userResponse, "tick") {
+			handleSeekPromptCmd(es, false, userResponse[len("tick"):])
+		} else if strings.HasPrefix(userResponse, "marks") {
+			handleBookmarkPromptCmd(es, bookmarkActionList, "")
+		} else if strings.HasPrefix(userResponse, "mark") {
+			handleBookmarkPromptCmd(es, bookmarkActionMark, userResponse[len("mark"):])
+		} else if strings.HasPrefix(userResponse, "goto") {
+			handleBookmarkPromptCmd(es, bookmarkActionGoto, userResponse[len("goto"):])
+		} else if userResponse == "error" || strings.HasPrefix(userResponse, "error ") {
+			severity, ok := parseErrorSeverityFromPrompt(userResponse[len("error"):])
+			if ok {
+				setErrorBreakpointFromPrompt(es, severity)
 			}
+		} else if strings.HasPrefix(userResponse, "connect") {
+			select {
+			case es.reconnectIde <- struct{}{}:
+			default:
+				color.Yellow("dontbug: Not waiting to connect to the IDE at the moment")
+			}
+		} else if strings.HasPrefix(userResponse, "t") {
+			setDirectionFromPrompt(es, mutex, &reverse, func(reverse bool) bool { return !reverse })
 		} else if strings.HasPrefix(userResponse, "r") {
-			mutex.Lock()
-			reverse = true
-			mutex.Unlock()
-			color.Red("In reverse mode")
+			setDirectionFromPrompt(es, mutex, &reverse, func(bool) bool { return true })
 		} else if strings.HasPrefix(userResponse, "f") {
-			mutex.Lock()
-			reverse = false
-			mutex.Unlock()
-			color.Green("In forward mode")
+			setDirectionFromPrompt(es, mutex, &reverse, func(bool) bool { return false })
 		} else if strings.HasPrefix(userResponse, "-") {
 			command := strings.TrimSpace(userResponse[1:])
-			result := sendGdbCommand(es.gdbSession, command)
+			runFromPrompt(es, false, func() {
+				result := sendGdbCommand(es.gdbSession, command)
 
-			jsonResult, err := json.MarshalIndent(result, "", "  ")
-			fatalIf(err)
+				jsonResult, err := json.MarshalIndent(result, "", "  ")
+				fatalIf(err)
 
-			fmt.Println(string(jsonResult))
+				fmt.Println(string(jsonResult))
+			})
 		} else if strings.HasPrefix(userResponse, "v") {
 			VerboseFlag = !VerboseFlag
 			if VerboseFlag {
@@ -417,8 +506,10 @@ func debuggerLoop(es *engineState, replayHost string, replayPort int) {
 			command := strings.TrimSpace(userResponse[1:])
 
 			// @TODO blacklist commands that are handled in gdb or dontbug instead
-			xmlResult := recoverableDiversionSessionCmd(es, command)
-			fmt.Println(xmlResult)
+			runFromPrompt(es, false, func() {
+				xmlResult := recoverableDiversionSessionCmd(es, command)
+				fmt.Println(xmlResult)
+			})
 		} else if strings.HasPrefix(userResponse, "q") {
 			color.Yellow("Exiting.")
 			return
@@ -434,140 +525,348 @@ func debuggerLoop(es *engineState, replayHost string, replayPort int) {
 	}
 }
 
-func debuggerIdeLoop(es *engineState, closeConnChan chan bool, mutex *sync.Mutex, reverse *bool, replayHost string, replayPort int) {
-	color.Yellow("dontbug: Trying to connect to debugger IDE")
-	conn, err := net.Dial("tcp", fmt.Sprintf("%v:%v", replayHost, replayPort))
-	if err != nil {
-		log.Fatalf("%v: Is your IDE listening for debugging connections from PHP?", err)
+// t, r and f on the dontbug prompt. The IDE is told of the new direction so this needs the engine like any other
+// prompt command that talks to the IDE. See runFromPrompt()
+func setDirectionFromPrompt(es *engineState, mutex *sync.Mutex, reverse *bool, direction func(reverse bool) bool) {
+	runFromPrompt(es, false, func() {
+		mutex.Lock()
+		*reverse = direction(*reverse)
+		newReverse := *reverse
+		mutex.Unlock()
+
+		notifyDirectionChangedToIde(es, newReverse)
+		updateSessionMode(es, newReverse)
+		if newReverse {
+			color.Red("In reverse mode")
+		} else {
+			color.Green("In forward mode")
+		}
+	})
+}
+
+// If listen is true we wait for the IDE to connect to us, otherwise we connect to the IDE
+// Either way, once the IDE disconnects we wait for (or try to make) a new connection. The replay
+// position and breakpoints remain as they were so the new IDE connection can simply carry on from there
+//
+// If dbgpProxy is not "" we connect to the DBGp proxy instead. The proxy looks at the idekey in our init packet
+// and routes the session to the IDE that registered itself with the proxy using that idekey
+func debuggerIdeLoop(es *engineState, quitChan chan bool, mutex *sync.Mutex, reverse *bool, replayHost string, replayPort int, listen bool, dbgpProxy string) {
+	address := fmt.Sprintf("%v:%v", replayHost, replayPort)
+	if dbgpProxy != "" {
+		address = dbgpProxy
+	}
+
+	var listener net.Listener
+	if listen {
+		var err error
+		listener, err = net.Listen("tcp", address)
+		if err != nil {
+			log.Fatalf("%v: Could not listen for debugger IDE connections on %v", err, address)
+		}
+		defer listener.Close()
+	}
+
+	backoff := ideDialInitialBackoff
+	for {
+		var conn net.Conn
+		if listen {
+			conn = acceptIdeConnection(listener, address)
+		} else {
+			conn = dialIdeConnection(address)
+		}
+
+		numCommands, ok := serveIdeConnection(es, conn, quitChan, mutex, reverse)
+		if !ok {
+			return
+		}
+
+		stopped := false
+		withEngine(es, func() {
+			stopped = es.status == statusStopped
+		})
+
+		// The IDE is probably still listening. Dialing it straight away would start a debugging session the user
+		// just stopped. So leave it to the user
+		if !listen && stopped {
+			color.Yellow("dontbug: The IDE stopped the debugging session. Type connect at the dontbug prompt to connect to it again")
+			<-es.reconnectIde
+			backoff = ideDialInitialBackoff
+			continue
+		}
+
+		if listen || numCommands > 0 {
+			backoff = ideDialInitialBackoff
+			continue
+		}
+
+		// The connection was closed before we got a single command. Don't hammer whoever is on the other side
+		if dbgpProxy != "" {
+			color.Yellow("dontbug: DBGp proxy at %v closed the connection. Is an IDE registered with the proxy using idekey %v? Retrying in %v", address, es.ideKey, backoff)
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > ideDialMaxBackoff {
+			backoff = ideDialMaxBackoff
+		}
+	}
+}
+
+func acceptIdeConnection(listener net.Listener, address string) net.Conn {
+	color.Yellow("dontbug: Listening for debugger IDE connections on %v", address)
+	conn, err := listener.Accept()
+	fatalIf(err)
+	return conn
+}
+
+// Keeps trying to connect to the IDE, backing off a bit more each time
+func dialIdeConnection(address string) net.Conn {
+	color.Yellow("dontbug: Trying to connect to debugger IDE at %v", address)
+	backoff := ideDialInitialBackoff
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			return conn
+		}
+
+		if backoff == ideDialInitialBackoff {
+			color.Yellow("dontbug: %v: Is your IDE listening for debugging connections from PHP? Will keep retrying", err)
+		} else {
+			Verboseln(fmt.Sprintf("dontbug: %v: Retrying in %v", err, backoff))
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > ideDialMaxBackoff {
+			backoff = ideDialMaxBackoff
+		}
+	}
+}
+
+// A new IDE knows nothing of what the previous IDE negotiated (features, stdout/stderr redirection, breakpoints etc.)
+// The replay position and the breakpoints the previous IDE did not set are retained however
+func resetEngineStateForNewIde(es *engineState) {
+	if es.status == statusStopped {
+		es.status = es.statusBeforeStop
+	}
+
+	if es.status != statusStopping {
+		es.status = statusStarting
+	}
+
+	clearQueuedRuns(es)
+	es.featureMap = initFeatureMap()
+	setIdeEncoding(es, dbgpEncoding(es))
+	es.stdFdModes = map[string]int{"stdout": 0, "stderr": 0}
+	updateStdFdBreakpoint(es)
+	es.pendingStreams = nil
+	removeIdeBreakpoints(es)
+
+	var bps breakpointsByID
+	for _, bp := range es.breakpoints {
+		if bp.bpType != breakpointTypeInternal {
+			bps = append(bps, bp)
+		}
 	}
+	sort.Sort(bps)
+
+	es.preexistingBreakpoints = nil
+	for _, bp := range bps {
+		es.preexistingBreakpoints = append(es.preexistingBreakpoints, bp.id)
+	}
+}
+
+// Returns the number of commands the IDE sent us (not counting break) and
+// false if we were asked to quit, true if the IDE disconnected
+func serveIdeConnection(es *engineState, conn net.Conn, quitChan chan bool, mutex *sync.Mutex, reverse *bool) (int, bool) {
+	withEngine(es, func() {
+		resetEngineStateForNewIde(es)
+	})
+	es.ideWriteMutex.Lock()
 	es.ideConnection = conn
+	es.ideWriteMutex.Unlock()
 	defer func() {
 		color.Yellow("dontbug: Closing connection to IDE")
 		conn.Close()
+		es.ideWriteMutex.Lock()
 		es.ideConnection = nil
-		fmt.Print("(dontbug) ")
+		es.ideWriteMutex.Unlock()
+		withEngine(es, func() {
+			fmt.Print(promptString(es))
+		})
 	}()
 
 	// send the init packet
-	payload := fmt.Sprintf(gInitXMLResponseFormat, es.entryFilePHP, os.Getpid())
-	packet := constructDbgpPacket(payload)
-	_, err = conn.Write(packet)
-	fatalIf(err)
+	payload := fmt.Sprintf(gInitXMLResponseFormat, es.entryFilePHP, os.Getpid(), xmlAttrEscape(es.ideKey))
+	packet := constructDbgpPacket(payload, dbgpEncoding(es))
+	_, err := conn.Write(packet)
+	if err != nil {
+		color.Yellow("dontbug: Could not send init packet to IDE: %v", err)
+		return 0, true
+	}
 
 	color.Green("dontbug: Connected to PHP IDE debugger")
 	buf := bufio.NewReader(conn)
 
-	go func(closeChan chan<- bool) {
-		defer func() {
-			r := recover()
-			if r != nil {
-				fmt.Println(r)
-				fmt.Println("Recovering from panic....")
-				color.Yellow("dontbug: Initiating shutdown of IDE connection. The dontbug prompt will be still operable")
-			}
-			closeChan <- true
-		}()
-
-		for es.status != statusStopped {
+	// The IDE may send a break (or status) while a run/step is in progress (we support async)
+	// So commands are read in a goroutine of their own and dispatched in another
+	commandChan := make(chan string, 16)
+	done := make(chan bool)
+	go func() {
+		defer close(commandChan)
+		for {
 			command, err := buf.ReadString(byte(0))
 			command = strings.TrimRight(command, "\x00")
 			if err == io.EOF {
 				Verboseln("dontbug: EOF Received on tcp connection to IDE")
-				break
+				return
 			} else if err != nil {
 				Verboseln("dontbug: IDE TCP connection was terminated")
-				break
+				return
 			}
 
 			if VerboseFlag {
 				color.Cyan("\nide -> dontbug: %v", command)
 			}
 
+			if handleAsyncIdeRequest(es, command) {
+				continue
+			}
+
+			if isRunCommand(command) {
+				queueRun(es)
+			}
+
+			select {
+			case commandChan <- command:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	numCommands := 0
+	go func() {
+		defer func() {
+			r := recover()
+			if r != nil {
+				fmt.Println(r)
+				fmt.Println("Recovering from panic....")
+				color.Yellow("dontbug: Initiating shutdown of IDE connection. The dontbug prompt will be still operable")
+			}
+			close(done)
+		}()
+
+		stopped := false
+		for !stopped {
+			command, ok := <-commandChan
+			if !ok {
+				break
+			}
+
+			numCommands++
 			mutex.Lock()
 			reverseVal := *reverse
 			mutex.Unlock()
 
-			payload = dispatchIdeRequest(es, command, reverseVal)
-			conn.Write(constructDbgpPacket(payload))
+			// The dontbug prompt could be driving gdb too. Wait for it to be done
+			withEngine(es, func() {
+				if isRunCommand(command) {
+					beginQueuedRun(es)
+					defer endRun(es)
+				}
 
-			if VerboseFlag {
-				continued := ""
-				if len(payload) > 300 {
-					continued = "..."
+				payload := dispatchIdeRequest(es, command, reverseVal)
+				sendPendingStreams(es)
+				sendToIde(es, payload)
+
+				if isSessionChangingCommand(command) {
+					updateSessionFromEngineState(es)
 				}
-				color.Green("dontbug -> ide:\n%.300v%v", payload, continued)
-				fmt.Print("(dontbug) ")
-			}
+				stopped = es.status == statusStopped
+			})
 		}
-	}(closeConnChan)
-	<-closeConnChan
+	}()
+
+	select {
+	case <-done:
+		return numCommands, true
+	case <-quitChan:
+		return numCommands, false
+	}
 }
 
-func dispatchIdeRequest(es *engineState, command string, reverseMode bool) string {
-	dbgpCmd := parseCommand(command, reverseMode)
-	es.lastSequenceNum = dbgpCmd.seqNum
-
-	switch dbgpCmd.command {
-	case "feature_set":
-		return handleFeatureSet(es, dbgpCmd)
-	case "feature_get":
-		return handleFeatureGet(es, dbgpCmd)
-	case "status":
-		return handleStatus(es, dbgpCmd)
-	case "breakpoint_set":
-		return handleBreakpointSet(es, dbgpCmd)
-	case "breakpoint_remove":
-		return handleBreakpointRemove(es, dbgpCmd)
-	case "breakpoint_update":
-		return handleBreakpointUpdate(es, dbgpCmd)
-	case "step_into":
-		return handleStepInto(es, dbgpCmd)
-	case "step_over":
-		return handleStepOverOrOut(es, dbgpCmd, false)
-	case "step_out":
-		return handleStepOverOrOut(es, dbgpCmd, true)
-	case "eval":
-		return handleInDiversionSessionWithNoGdbBpts(es, dbgpCmd)
-	case "stdout":
-		return handleStdFd(es, dbgpCmd, "stdout")
-	case "stdin":
-		return handleStdFd(es, dbgpCmd, "stdin")
-	case "stderr":
-		return handleStdFd(es, dbgpCmd, "stderr")
-	case "property_set":
-		return handlePropertySet(es, dbgpCmd)
-	case "property_get":
-		return handleInDiversionSessionWithNoGdbBpts(es, dbgpCmd)
-	case "context_get":
-		return handleInDiversionSessionWithNoGdbBpts(es, dbgpCmd)
-	case "run":
-		return handleRun(es, dbgpCmd)
-	case "stop":
-		color.Yellow("IDE sent 'stop' command")
-		return handleStop(es, dbgpCmd)
-		// All these are dealt with in handleInDiversionSessionStandard()
-	case "stack_get":
-		return handleInDiversionSessionStandard(es, dbgpCmd)
-	case "stack_depth":
-		return handleInDiversionSessionStandard(es, dbgpCmd)
-	case "context_names":
-		return handleInDiversionSessionStandard(es, dbgpCmd)
-	case "typemap_get":
-		return handleInDiversionSessionStandard(es, dbgpCmd)
-	case "source":
-		return handleInDiversionSessionStandard(es, dbgpCmd)
-	case "property_value":
-		return handleInDiversionSessionStandard(es, dbgpCmd)
-	default:
-		es.sourceMap = nil // Just to reduce size of map dump to stdout
-		fmt.Println(es)
-		panicIf(fmt.Errorf("Unimplemented command: %v", command))
-	}
-
-	return ""
+// break can only be handled while a run/step is in progress. status is allowed at that time too
+// Returns true if the command was dealt with here
+func handleAsyncIdeRequest(es *engineState, command string) bool {
+	dCmd, err := parseCommand(command, false)
+	if err != nil {
+		return false
+	}
+
+	if dCmd.command == "break" {
+		sendToIde(es, handleBreak(es, dCmd))
+		return true
+	}
+
+	// es.status belongs to the goroutine doing the run/step so don't look at it here
+	if dCmd.command == "status" && isRunning(es) {
+		sendToIde(es, fmt.Sprintf(gStatusXMLResponseFormat, dCmd.seqNum, statusRunning, es.reason))
+		return true
+	}
+
+	return false
 }
 
-func constructBreakpointLocMap(extensionDir string) (map[string]int, []int, int) {
+// Commands that run/step (in either direction) and can be interrupted by a break. See queueRun()
+func isRunCommand(command string) bool {
+	dCmd, err := parseCommand(command, false)
+	if err != nil {
+		return false
+	}
+
+	switch dCmd.command {
+	case "run", "step_into", "step_over", "step_out", "dontbug_request", "dontbug_seek":
+		return true
+	case "dontbug_bookmark":
+		return dCmd.options["a"] == bookmarkActionGoto
+	}
+
+	return false
+}
+
+// Responses to the IDE could be sent from more than one goroutine so all writes go through here
+func sendToIde(es *engineState, payload string) {
+	es.ideWriteMutex.Lock()
+	defer es.ideWriteMutex.Unlock()
+
+	if es.ideConnection == nil {
+		return
+	}
+
+	es.ideConnection.Write(constructDbgpPacket(payload, es.ideEncoding))
+
+	if VerboseFlag {
+		continued := ""
+		if len(payload) > 300 {
+			continued = "..."
+		}
+		color.Green("dontbug -> ide:\n%.300v%v", payload, continued)
+		fmt.Print("(dontbug) ")
+	}
+}
+
+// A break response is sent from the goroutine reading IDE commands, which must not look at es.featureMap
+// So the encoding to send packets in is kept here too
+func setIdeEncoding(es *engineState, encoding string) {
+	es.ideWriteMutex.Lock()
+	defer es.ideWriteMutex.Unlock()
+	es.ideEncoding = encoding
+}
+
+// Also returns the line in dontbug_break.c for breakpoints in PHP files that are not in the map. This is 0 if
+// dontbug_break.c was generated by an older version of dontbug and does not have such a line
+func constructBreakpointLocMap(extensionDir string) (map[string]int, []int, int, int) {
 	absExtDir := getAbsNoSymlinkPath(extensionDir)
 	dontbugBreakFilename := absExtDir + "/dontbug_break.c"
 	Verboseln("dontbug: Looking for dontbug_break.c in", absExtDir)
@@ -582,6 +881,7 @@ func constructBreakpointLocMap(extensionDir string) (map[string]int, []int, int)
 
 	level := 0
 	lineno := 0
+	fallbackLine := 0
 
 	line, err := buf.ReadString('\n')
 	lineno++
@@ -631,6 +931,10 @@ func constructBreakpointLocMap(extensionDir string) (map[string]int, []int, int)
 			levelLocAr[level] = lineno
 			level++
 		}
+
+		if strings.Contains(line, fallbackSentinel) {
+			fallbackLine = lineno
+		}
 	}
 
 	if len(bpLocMap) != numFiles {
@@ -638,5 +942,5 @@ func constructBreakpointLocMap(extensionDir string) (map[string]int, []int, int)
 	}
 
 	Verboseln("dontbug: Completed building association of filename => linenumbers and levels => linenumbers for breakpoints")
-	return bpLocMap, levelLocAr, maxStackDepth
+	return bpLocMap, levelLocAr, maxStackDepth, fallbackLine
 }
@@ -0,0 +1,206 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	"strconv"
+	"strings"
+)
+
+const (
+	// See dontbug_request_start_location() in dontbug.c
+	dontbugRequestStartLocation = "dontbug_request_start_location"
+
+	requestNext     = "next"
+	requestPrevious = "previous"
+)
+
+type phpRequest struct {
+	num    int
+	method string // "" for the PHP CLI
+	uri    string
+}
+
+func (r phpRequest) String() string {
+	if r.method == "" && r.uri == "" {
+		return fmt.Sprintf("request %v", r.num)
+	}
+
+	return fmt.Sprintf("request %v: %v %v", r.num, r.method, r.uri)
+}
+
+func init() {
+	registerDbgpCmdHandler("dontbug_request", handleDontbugRequest)
+}
+
+// dontbug_request [-n next|previous|<request number>]
+// A recording made with the PHP built-in webserver can have many (web) requests. This goes to the first PHP
+// statement of the requested one. Without -n, we stay where we are and just describe the current request
+func handleDontbugRequest(es *engineState, dCmd dbgpCmd) string {
+	n, ok := dCmd.options["n"]
+	if ok {
+		_, err := gotoPhpRequestByName(es, n)
+		if err != nil {
+			return fmt.Sprintf(gErrorXMLResponseFormat, "dontbug_request", dCmd.seqNum, dbgpErrorCodeInvalidOptions, xmlAttrEscape(err.Error()))
+		}
+	} else if es.status == statusStopping {
+		return traceEndNotAvailableResponse(dCmd)
+	}
+
+	notifyIfRequestChanged(es)
+	resolvePendingWatchBreakpoints(es)
+	recordRRPosition(es)
+
+	request := currentPhpRequest(es)
+	filename, phpLineno := phpFilenameAndLineno(es)
+	return fmt.Sprintf(gDontbugRequestXMLResponseFormat, dontbugXMLNamespace, dCmd.seqNum, request.num,
+		xmlAttrEscape(request.method), xmlAttrEscape(request.uri), es.rrPosition.event, es.rrPosition.ticks, filename, phpLineno)
+}
+
+// name is next, previous or the request number
+func gotoPhpRequestByName(es *engineState, name string) (phpRequest, error) {
+	current := currentPhpRequestNum(es)
+
+	var num int
+	switch name {
+	case requestNext:
+		num = current + 1
+	case requestPrevious:
+		num = current - 1
+	default:
+		var err error
+		num, err = strconv.Atoi(name)
+		if err != nil {
+			return phpRequest{}, errors.New("Please specify next, previous or a request number. Got: " + name)
+		}
+	}
+
+	if num < 1 {
+		return phpRequest{}, errors.New("There are no requests before request 1")
+	}
+
+	return gotoPhpRequest(es, current, num)
+}
+
+// Runs (in whichever direction is needed) to the start of request num and then on to its first PHP statement
+// Only request starts are marked in the trace (see PHP_RINIT_FUNCTION in dontbug.c). There is no request end to go to
+// PHP breakpoints on the way are ignored
+func gotoPhpRequest(es *engineState, current int, num int) (phpRequest, error) {
+	// Going to the current request means going back to its start
+	reverse := num <= current
+
+	var stopID string
+	var breakErr *engineBreakpointError
+	withAllGdbBreakpointsDisabled(es, func() {
+		var gdbID string
+		gdbID, breakErr = setPhpHookBreakpointInGdb(es, dontbugRequestStartLocation, fmt.Sprintf("request_num == %v", num), false, true)
+		if breakErr != nil {
+			return
+		}
+
+		stopID, _ = continueExecution(es, reverse)
+		if stopID != gdbID {
+			// gdb only deletes a temporary breakpoint after it is hit
+			sendGdbCommand(es.gdbSession, "break-delete", gdbID)
+		}
+	})
+
+	if breakErr != nil {
+		return phpRequest{}, errors.New(breakErr.message)
+	}
+
+	if stopID == stopIDTraceEnd || stopID == stopIDTraceStart || stopID == stopIDInterrupted {
+		// We're no longer on a PHP statement. Go back to the nearest one
+		settleReverse := stopID == stopIDTraceEnd || (stopID == stopIDInterrupted && reverse)
+		id, _ := gotoMasterBpLocationWithNoPhpBpts(es, settleReverse)
+		if id == stopIDTraceEnd || id == stopIDTraceStart {
+			gotoMasterBpLocationWithNoPhpBpts(es, !settleReverse)
+		}
+
+		if stopID == stopIDInterrupted {
+			return phpRequest{}, fmt.Errorf("Interrupted while going to request %v", num)
+		}
+		return phpRequest{}, fmt.Errorf("There is no request %v in this recording", num)
+	}
+
+	request := phpRequest{
+		num:    num,
+		method: toUTF8(xSlashSgdb(es.gdbSession, "method")),
+		uri:    toUTF8(xSlashSgdb(es.gdbSession, "uri")),
+	}
+
+	settleOnPhpStatement(es)
+	if currentPhpRequestNum(es) != num {
+		color.Yellow("dontbug: %v did not execute any PHP statements. Stopped at the nearest PHP statement instead", request)
+	}
+
+	return request, nil
+}
+
+func currentPhpRequestNum(es *engineState) int {
+	num, err := strconv.Atoi(xGdbCmdValue(es.gdbSession, "dontbug_request_num"))
+	panicIf(err)
+	return num
+}
+
+func currentPhpRequest(es *engineState) phpRequest {
+	return phpRequest{
+		num:    currentPhpRequestNum(es),
+		method: toUTF8(xSlashSgdb(es.gdbSession, "dontbug_request_method()")),
+		uri:    toUTF8(xSlashSgdb(es.gdbSession, "dontbug_request_uri()")),
+	}
+}
+
+// request, request next, request previous or request <number> on the dontbug prompt
+func handleRequestPromptCmd(es *engineState, args string) {
+	args = strings.TrimSpace(args)
+	if args == "" {
+		runFromPrompt(es, false, func() {
+			if es.status == statusStopping {
+				color.Yellow("dontbug: At the end of the trace")
+				return
+			}
+
+			color.Green("dontbug: In %v", currentPhpRequest(es))
+		})
+		return
+	}
+
+	if args == "n" {
+		args = requestNext
+	} else if args == "p" {
+		args = requestPrevious
+	}
+
+	runFromPrompt(es, true, func() {
+		request, err := gotoPhpRequestByName(es, args)
+		if err != nil {
+			color.Red("dontbug: %v", err)
+			return
+		}
+
+		notifyIfRequestChanged(es)
+		resolvePendingWatchBreakpoints(es)
+		recordRRPosition(es)
+		updateSessionFromEngineState(es)
+
+		filename, phpLineno := phpFilenameAndLineno(es)
+		color.Green("dontbug: Went to %v. Now at %v:%v (%v)", request, filename, phpLineno, es.rrPosition)
+		color.Yellow("dontbug: Your IDE will show the new position after your next step or run")
+	})
+}
@@ -16,7 +16,7 @@ package engine
 
 var gInitXMLResponseFormat = `<init xmlns="urn:debugger_protocol_v1" language="PHP" protocol_version="1.0"
 		fileuri="file://%v"
-		appid="%v" idekey="dontbug">
+		appid="%v" idekey="%v">
 		<engine version="0.0.1"><![CDATA[dontbug]]></engine>
 	</init>`
 
@@ -33,7 +33,10 @@ var gStatusXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" comma
 		transaction_id="%v" status="%v" reason="%v">
 	</response>`
 
-var gBreakpointSetLineXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" command="breakpoint_set" transaction_id="%v" status="%v" id="%v">
+var gBreakpointSetXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" command="breakpoint_set" transaction_id="%v" status="%v" id="%v">
+	</response>`
+
+var gBreakpointSetLineResolvedXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" command="breakpoint_set" transaction_id="%v" status="%v" id="%v" resolved="resolved">
 	</response>`
 
 var gErrorXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" command="%v" transaction_id="%v">
@@ -42,21 +45,54 @@ var gErrorXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" comman
     		</error>
 	</response>`
 
+var gBreakpointGetXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" command="breakpoint_get" transaction_id="%v">
+		%v
+	</response>`
+
+var gBreakpointListXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" command="breakpoint_list" transaction_id="%v">
+		%v
+	</response>`
+
+var gBreakpointXMLFormat = `<breakpoint id="%v" type="%v" filename="%v" lineno="%v" state="%v" temporary="%v" hit_count="%v" hit_value="%v"%v>%v</breakpoint>`
+
 var gBreakpointRemoveOrUpdateXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" command="%v" transaction_id="%v">
 	</response>`
 
-var gStepIntoBreakXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" xmlns:xdebug="http://xdebug.org/dbgp/xdebug" command="step_into"
-		transaction_id="%v" status="break" reason="ok">
-		<xdebug:message filename="%v" lineno="%v"></xdebug:message>
+// dontbug:event and dontbug:ticks are the position in the rr trace. See dontbug_seek
+var gRunOrStepBreakXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" xmlns:xdebug="http://xdebug.org/dbgp/xdebug" xmlns:dontbug="%v" command="%v"
+		transaction_id="%v" status="break" reason="ok" dontbug:event="%v" dontbug:ticks="%v">
+		<xdebug:message filename="%v" lineno="%v"%v>%v</xdebug:message>
 	</response>`
 
-var gRunOrStepBreakXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" xmlns:xdebug="http://xdebug.org/dbgp/xdebug" command="%v"
-		transaction_id="%v" status="break" reason="ok">
+// Same as a run/step response but also describes the (web) request we're in. See handleDontbugRequest()
+var gDontbugRequestXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" xmlns:xdebug="http://xdebug.org/dbgp/xdebug" xmlns:dontbug="%v"
+		command="dontbug_request" transaction_id="%v" status="break" reason="ok" dontbug:request="%v" dontbug:method="%v" dontbug:uri="%v"
+		dontbug:event="%v" dontbug:ticks="%v">
 		<xdebug:message filename="%v" lineno="%v"></xdebug:message>
 	</response>`
 
-// @TODO Always fail the stdout/stdout/stderr commands, until this is implemented
-var gStdFdXMLResponseFormat = `<response transaction_id="%v" command="%v" success="0"></response>`
+var gDontbugBookmarkXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" xmlns:dontbug="%v" command="dontbug_bookmark" transaction_id="%v">%v</response>`
+
+var gDontbugBookmarkXMLFormat = `<dontbug:bookmark name="%v" filename="%v" lineno="%v" event="%v" ticks="%v"></dontbug:bookmark>`
+
+var gRunOrStepStatusXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" command="%v"
+		transaction_id="%v" status="%v" reason="%v">
+	</response>`
+
+var gBreakXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" command="break" transaction_id="%v" success="%v"></response>`
+
+var gStdFdXMLResponseFormat = `<response xmlns="urn:debugger_protocol_v1" transaction_id="%v" command="%v" success="%v"></response>`
+
+var gStreamXMLFormat = `<stream xmlns="urn:debugger_protocol_v1" xmlns:dontbug="%v" type="%v" encoding="base64" dontbug:direction="%v">%v</stream>`
 
 // Replay under rr is read-only. The property set function is to fail, always.
 var gPropertySetXMLResponseFormat = `<response transaction_id="%v" command="property_set" success="0"></response>`
+
+var gBreakpointResolvedNotifyXMLFormat = `<notify xmlns="urn:debugger_protocol_v1" name="breakpoint_resolved">
+		<breakpoint id="%v" type="%v" resolved="resolved" filename="%v" lineno="%v" state="%v"></breakpoint>
+	</notify>`
+
+// Same notification but with everything breakpoint_get would tell about the breakpoint
+var gBreakpointFullResolvedNotifyXMLFormat = `<notify xmlns="urn:debugger_protocol_v1" name="breakpoint_resolved">%v</notify>`
+
+var gDontbugNotifyXMLFormat = `<notify xmlns="urn:debugger_protocol_v1" xmlns:dontbug="%v" name="dontbug:%v"%v></notify>`
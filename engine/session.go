@@ -0,0 +1,319 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Saved in the rr trace directory so that a later `dontbug replay` of the same trace can carry on from where we were
+const sessionFilename = "dontbug-session.json"
+
+type engineSession struct {
+	Reverse     bool                      `json:"reverse"`
+	Event       int64                     `json:"event"`           // rr event of the last PHP statement we stopped at. 0 if none
+	Ticks       int64                     `json:"ticks,omitempty"` // rr ticks of that PHP statement. See currentRRTicks()
+	Breakpoints []engineSessionBreakpoint `json:"breakpoints"`
+}
+
+type engineSessionBreakpoint struct {
+	Type         string `json:"type"`
+	Filename     string `json:"filename,omitempty"`
+	Lineno       int    `json:"lineno,omitempty"`
+	State        string `json:"state"`
+	Temporary    bool   `json:"temporary,omitempty"`
+	HitValue     int    `json:"hit_value,omitempty"`
+	HitCondition string `json:"hit_condition,omitempty"`
+	Function     string `json:"function,omitempty"`
+	Exception    string `json:"exception,omitempty"`
+	Expression   string `json:"expression,omitempty"`
+}
+
+// The directory of the rr trace being replayed. traceDir is "" for the latest trace
+func getRRTraceDir(traceDir string) string {
+	if traceDir == "" {
+		currentUser, err := user.Current()
+		fatalIf(err)
+		traceDir = currentUser.HomeDir + "/.local/share/rr/latest-trace"
+	}
+
+	// latest-trace is a symlink to the actual trace directory
+	absTraceDir, err := filepath.EvalSymlinks(traceDir)
+	if err != nil {
+		color.Yellow("dontbug: Could not find the rr trace directory %v. Debugging sessions will not be saved", traceDir)
+		return ""
+	}
+
+	return absTraceDir
+}
+
+func loadSession(traceDir string) (engineSession, bool) {
+	var session engineSession
+	data, err := ioutil.ReadFile(path.Join(traceDir, sessionFilename))
+	if err != nil {
+		return session, false
+	}
+
+	err = json.Unmarshal(data, &session)
+	if err != nil {
+		color.Yellow("dontbug: Ignoring saved debugging session as it could not be read: %v", err)
+		return session, false
+	}
+
+	return session, true
+}
+
+func askUserToRestoreSession(session engineSession) bool {
+	mode := "forward"
+	if session.Reverse {
+		mode = "reverse"
+	}
+
+	color.Yellow("dontbug: Found a saved debugging session for this trace: %v breakpoint(s), %v mode, rr event %v", len(session.Breakpoints), mode, session.Event)
+	for {
+		var answer string
+		fmt.Print("Restore it? [Y/n]> ")
+		fmt.Scanln(&answer)
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer == "" || answer == "y" || answer == "yes" {
+			return true
+		} else if answer == "n" || answer == "no" {
+			return false
+		}
+	}
+}
+
+// Goes back to the saved position and installs the saved breakpoints again. The IDE may send its breakpoints
+// too when it connects. Each of those takes over the restored breakpoint it matches. See getMatchingPhpBreakpoint()
+func restoreSession(es *engineState, session engineSession) {
+	if session.Event > 0 && gotoRRPosition(es, rrPosition{session.Event, session.Ticks}) {
+		// As far as the IDE is concerned, we're only starting out
+		es.status = statusStarting
+	}
+
+	dCmds := make([]dbgpCmd, 0, len(session.Breakpoints))
+	for _, sbp := range session.Breakpoints {
+		dCmds = append(dCmds, sessionBreakpointToDbgpCmd(sbp))
+	}
+
+	for i, response := range setUnclaimedBreakpoints(es, dCmds) {
+		if strings.Contains(response, "<error") {
+			sbp := session.Breakpoints[i]
+			color.Yellow("dontbug: Could not restore %v breakpoint %v", sbp.Type, sessionBreakpointDescription(sbp))
+		}
+	}
+
+	es.session.Reverse = session.Reverse
+	es.session.Event = session.Event
+	es.session.Ticks = session.Ticks
+	updateSessionFromEngineState(es)
+	color.Green("dontbug: Restored saved debugging session")
+}
+
+// rr can restart the replay at any event. We then settle on the next PHP statement
+// Returns false if rr could not go to the event, in which case we stay where we were
+func gotoRREvent(es *engineState, event int64) bool {
+	if !restartAtRREvent(es, event) {
+		color.Yellow("dontbug: Could not go to rr event %v", event)
+		return false
+	}
+
+	settleOnPhpStatement(es)
+	return true
+}
+
+// The replay is restarted at the event. We're usually not at a PHP statement at that point
+func restartAtRREvent(es *engineState, event int64) bool {
+	sendGdbCommand(es.gdbSession, "gdb-set", "confirm", "off")
+	result := sendGdbCommand(es.gdbSession, "interpreter-exec", "console", fmt.Sprintf("\"run %v\"", event))
+	if result["class"] == "error" {
+		return false
+	}
+
+	// The stop at the event itself
+	<-es.breakStopNotify
+	return true
+}
+
+// An rr event can be many PHP statements before the one we were at. So after going to the event, we go forward a
+// statement at a time till we reach the ticks of the position. ticks of 0 means just the event will do
+func gotoRRPosition(es *engineState, position rrPosition) bool {
+	if !gotoRREvent(es, position.event) {
+		return false
+	}
+
+	for position.ticks > 0 && currentRRTicks(es) < position.ticks {
+		id, _ := gotoMasterBpLocationWithNoPhpBpts(es, false)
+		if id == stopIDTraceEnd {
+			color.Yellow("dontbug: Could not find rr tick %v after rr event %v", position.ticks, position.event)
+			gotoMasterBpLocationWithNoPhpBpts(es, true)
+			break
+		}
+	}
+
+	return true
+}
+
+// The breakpoint_set command that would set up the saved breakpoint
+func sessionBreakpointToDbgpCmd(sbp engineSessionBreakpoint) dbgpCmd {
+	options := map[string]string{"t": sbp.Type, "s": sbp.State}
+	if sbp.Filename != "" {
+		options["f"] = sbp.Filename
+		options["n"] = strconv.Itoa(sbp.Lineno)
+	}
+
+	if sbp.Temporary {
+		options["r"] = "1"
+	}
+
+	if sbp.HitValue > 0 {
+		options["h"] = strconv.Itoa(sbp.HitValue)
+		if sbp.HitCondition != "" {
+			options["o"] = sbp.HitCondition
+		}
+	}
+
+	if sbp.Function != "" {
+		options["m"] = sbp.Function
+	}
+
+	if sbp.Exception != "" {
+		options["x"] = sbp.Exception
+	}
+
+	return dbgpCmd{
+		command:     "breakpoint_set",
+		fullCommand: "breakpoint_set (restored from " + sessionFilename + ")",
+		options:     options,
+		data:        sbp.Expression,
+	}
+}
+
+func sessionBreakpointDescription(sbp engineSessionBreakpoint) string {
+	switch {
+	case sbp.Filename != "":
+		return fmt.Sprintf("%v:%v", sbp.Filename, sbp.Lineno)
+	case sbp.Function != "":
+		return sbp.Function
+	case sbp.Exception != "":
+		return sbp.Exception
+	default:
+		return sbp.Expression
+	}
+}
+
+// Commands after which the session is worth saving again
+func isSessionChangingCommand(command string) bool {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return false
+	}
+
+	name := fields[0]
+	return strings.HasPrefix(name, "breakpoint_") || strings.HasPrefix(name, "step_") || name == "run" ||
+		name == "dontbug_request" || name == "dontbug_seek" || name == "dontbug_bookmark"
+}
+
+// Talks to gdb and reads the breakpoints table so the engine must be ours. See acquireEngine()
+func updateSessionFromEngineState(es *engineState) {
+	if es.traceDir == "" {
+		return
+	}
+
+	var bps []*engineBreakPoint
+	for _, bp := range es.breakpoints {
+		if bp.bpType != breakpointTypeInternal {
+			bps = append(bps, bp)
+		}
+	}
+	sort.Sort(breakpointsByID(bps))
+
+	sessionBps := make([]engineSessionBreakpoint, 0, len(bps))
+	for _, bp := range bps {
+		sessionBps = append(sessionBps, engineSessionBreakpoint{
+			Type:         string(bp.bpType),
+			Filename:     bp.filename,
+			Lineno:       bp.lineno,
+			State:        string(bp.state),
+			Temporary:    bp.temporary,
+			HitValue:     bp.hitValue,
+			HitCondition: string(bp.hitCondition),
+			Function:     bp.function,
+			Exception:    bp.exception,
+			Expression:   bp.expression,
+		})
+	}
+
+	// recordRRPosition() has already noted where we are
+	updatePosition := es.status == statusBreak && es.rrPosition.event > 0
+
+	es.sessionMutex.Lock()
+	es.session.Breakpoints = sessionBps
+	if updatePosition {
+		es.session.Event = es.rrPosition.event
+		es.session.Ticks = es.rrPosition.ticks
+	}
+	es.sessionMutex.Unlock()
+
+	saveSession(es)
+}
+
+// Called from the dontbug prompt, so this must not talk to gdb
+func updateSessionMode(es *engineState, reverse bool) {
+	es.sessionMutex.Lock()
+	es.session.Reverse = reverse
+	es.sessionMutex.Unlock()
+
+	saveSession(es)
+}
+
+func saveSession(es *engineState) {
+	if es.traceDir == "" {
+		return
+	}
+
+	es.sessionMutex.Lock()
+	defer es.sessionMutex.Unlock()
+
+	data, err := json.MarshalIndent(es.session, "", "  ")
+	fatalIf(err)
+
+	err = ioutil.WriteFile(path.Join(es.traceDir, sessionFilename), data, os.FileMode(0644))
+	if err != nil {
+		color.Yellow("dontbug: Could not save debugging session: %v", err)
+	}
+}
+
+// rr's position in the trace in terms of its events. Coarser than currentRRTicks() but rr can go to any event directly
+func currentRREvent(es *engineState) int64 {
+	output := xGdbConsoleCmd(es, "when")
+
+	// Looks like: Current event: 1234
+	colon := strings.LastIndex(output, ":")
+	event, err := strconv.ParseInt(strings.TrimSpace(output[colon+1:]), 10, 64)
+	panicIf(err)
+
+	return event
+}
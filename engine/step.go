@@ -16,12 +16,35 @@ package engine
 
 import "fmt"
 
+func init() {
+	registerDbgpCmdHandler("step_into", handleStepInto)
+	registerDbgpCmdHandler("step_over", func(es *engineState, dCmd dbgpCmd) string {
+		return handleStepOverOrOut(es, dCmd, false)
+	})
+	registerDbgpCmdHandler("step_out", func(es *engineState, dCmd dbgpCmd) string {
+		return handleStepOverOrOut(es, dCmd, true)
+	})
+}
+
 func handleStepInto(es *engineState, dCmd dbgpCmd) string {
-	gotoMasterBpLocation(es, dCmd.reverse)
+	if es.status == statusStopping && !dCmd.reverse {
+		return traceEndResponse(es, "step_into", dCmd.seqNum)
+	}
+
+	id, _ := gotoMasterBpLocation(es, dCmd.reverse)
+	if id == stopIDInterrupted {
+		return interruptedResponse(es, "step_into", dCmd.seqNum, dCmd.reverse)
+	}
+
+	if id == stopIDTraceEnd {
+		return traceEndResponse(es, "step_into", dCmd.seqNum)
+	}
+
+	if id == stopIDTraceStart {
+		gotoMasterBpLocationWithNoPhpBpts(es, false)
+	}
 
-	filename := xSlashSgdb(es.gdbSession, "filename")
-	lineno := xSlashDgdb(es.gdbSession, "lineno")
-	return fmt.Sprintf(gStepIntoBreakXMLResponseFormat, dCmd.seqNum, filename, lineno)
+	return phpBreakResponse(es, "step_into", dCmd.seqNum)
 }
 
 func handleStepOverOrOut(es *engineState, dCmd dbgpCmd, stepOut bool) string {
@@ -30,7 +53,18 @@ func handleStepOverOrOut(es *engineState, dCmd dbgpCmd, stepOut bool) string {
 		command = "step_out"
 	}
 
-	currentPhpStackLevel := xSlashDgdb(es.gdbSession, "level")
+	if es.status == statusStopping {
+		if !dCmd.reverse {
+			return traceEndResponse(es, command, dCmd.seqNum)
+		}
+
+		// There is no PHP stack level to speak of at the end of the trace
+		// Simply go back to the last PHP statement
+		gotoMasterBpLocationWithNoPhpBpts(es, true)
+		return phpBreakResponse(es, command, dCmd.seqNum)
+	}
+
+	currentPhpStackLevel := phpStackLevel(es)
 	levelLimit := currentPhpStackLevel
 	if stepOut && currentPhpStackLevel > 0 {
 		levelLimit = currentPhpStackLevel - 1
@@ -39,21 +73,45 @@ func handleStepOverOrOut(es *engineState, dCmd dbgpCmd, stepOut bool) string {
 	// We're interested in maintaining or decreasing the stack level for step over
 	// We're interested in strictly decreasing the stack level for step out
 	id := setPhpStackDepthLevelBreakpointInGdb(es, levelLimit)
-	_, ok := continueExecution(es, dCmd.reverse)
+	stopID, ok := continueExecution(es, dCmd.reverse)
+
+	if stopID == stopIDInterrupted {
+		removeGdbBreakpoint(es, id)
+		return interruptedResponse(es, command, dCmd.seqNum, dCmd.reverse)
+	}
 
 	if !dCmd.reverse {
 		// Cleanup
 		removeGdbBreakpoint(es, id)
 
+		if stopID == stopIDTraceEnd {
+			return traceEndResponse(es, command, dCmd.seqNum)
+		}
+
+		if ok && stayAtBreakpointHit(es) {
+			return phpBreakResponse(es, command, dCmd.seqNum)
+		}
+
 		gotoMasterBpLocation(es, false)
+	} else if stopID == stopIDTraceStart {
+		// Cleanup
+		removeGdbBreakpoint(es, id)
+
+		gotoMasterBpLocationWithNoPhpBpts(es, false)
 	} else {
 		// A user (php) breakpoint was hit
+		if ok && atWatchBreakpoint(es) {
+			// Report the statement that wrote to the variable. See stayAtBreakpointHit()
+			removeGdbBreakpoint(es, id)
+			return phpBreakResponse(es, command, dCmd.seqNum)
+		}
+
 		if ok {
 			// Cleanup
 			removeGdbBreakpoint(es, id)
 
 			// What stack level are we on currently?
-			levelLimit := xSlashDgdb(es.gdbSession, "level")
+			levelLimit := phpStackLevel(es)
 
 			// Disable all currently active breaks
 			bpList := getEnabledPhpBreakpoints(es)
@@ -85,8 +143,74 @@ func handleStepOverOrOut(es *engineState, dCmd dbgpCmd, stepOut bool) string {
 		gotoMasterBpLocation(es, false)
 	}
 
-	filename := xSlashSgdb(es.gdbSession, "filename")
-	phpLineno := xSlashDgdb(es.gdbSession, "lineno")
+	return phpBreakResponse(es, command, dCmd.seqNum)
+}
+
+// Return and exception breakpoints stay in the hook function (see atBreakpointInHookFunction()). Watch breakpoints
+// stay where the variable was written, which is somewhere in the middle of the PHP statement that did the write
+func stayAtBreakpointHit(es *engineState) bool {
+	return atBreakpointInHookFunction(es) || atWatchBreakpoint(es)
+}
+
+// At a watch breakpoint, we're not in any of the dontbug_*_location() functions in dontbug.c
+// So the filename, lineno and level arguments of those functions are not available
+func phpFilenameAndLineno(es *engineState) (string, int) {
+	if atWatchBreakpoint(es) {
+		filename := toUTF8(xSlashSgdb(es.gdbSession, "dontbug_current_filename()"))
+		return filename, xSlashDgdb(es.gdbSession, "dontbug_current_lineno()")
+	}
+
+	return toUTF8(xSlashSgdb(es.gdbSession, "filename")), xSlashDgdb(es.gdbSession, "lineno")
+}
+
+func phpStackLevel(es *engineState) int {
+	if atWatchBreakpoint(es) {
+		return xSlashDgdb(es.gdbSession, "dontbug_current_level()")
+	}
+
+	return xSlashDgdb(es.gdbSession, "level")
+}
+
+// Response for run/step_* once we have settled on a PHP statement
+func phpBreakResponse(es *engineState, command string, seqNum int) string {
+	notifyIfRequestChanged(es)
+	resolvePendingWatchBreakpoints(es)
+	recordRRPosition(es)
+
+	filename, phpLineno := phpFilenameAndLineno(es)
+
+	extraAttrs := ""
+	message := ""
+	if atErrorBreakpoint(es) {
+		// Like Xdebug, the severity goes in the exception attribute
+		severityName, errorMessage := currentPhpError(es)
+		extraAttrs = fmt.Sprintf(" exception=\"%v\"", xmlAttrEscape(severityName))
+		message = xmlAttrEscape(errorMessage)
+	} else if atBreakpointInHookFunction(es) && es.lastHitBreakpoint.bpType == breakpointTypeException {
+		exceptionName := toUTF8(xSlashSgdb(es.gdbSession, "exception_name"))
+		extraAttrs = fmt.Sprintf(" exception=\"%v\"", xmlAttrEscape(exceptionName))
+	}
+
+	return fmt.Sprintf(gRunOrStepBreakXMLResponseFormat, dontbugXMLNamespace, command, seqNum, es.rrPosition.event, es.rrPosition.ticks, filename, phpLineno, extraAttrs, message)
+}
+
+// Response for run/step_* when there is nothing more to execute in the forward direction
+func traceEndResponse(es *engineState, command string, seqNum int) string {
+	recordRRPosition(es)
+	return fmt.Sprintf(gRunOrStepStatusXMLResponseFormat, command, seqNum, statusStopping, es.reason)
+}
+
+// Response for run/step_* after a break command (or Ctrl-C) interrupted it
+// We could be anywhere in the PHP interpreter so settle on the nearest PHP statement in the direction we were going
+func interruptedResponse(es *engineState, command string, seqNum int, reverse bool) string {
+	id, _ := gotoMasterBpLocationWithNoPhpBpts(es, reverse)
+	if id == stopIDTraceEnd {
+		return traceEndResponse(es, command, seqNum)
+	}
+
+	if id == stopIDTraceStart {
+		gotoMasterBpLocationWithNoPhpBpts(es, false)
+	}
 
-	return fmt.Sprintf(gRunOrStepBreakXMLResponseFormat, command, dCmd.seqNum, filename, phpLineno)
+	return phpBreakResponse(es, command, seqNum)
 }
@@ -0,0 +1,200 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/fatih/color"
+	"strconv"
+	"strings"
+)
+
+// The output of a single write(2) to stdout/stderr that was encountered while running forwards or backwards
+type engineStreamChunk struct {
+	fdName  string
+	data    []byte
+	reverse bool
+}
+
+func init() {
+	registerDbgpCmdHandler("stdout", func(es *engineState, dCmd dbgpCmd) string {
+		return handleStdFd(es, dCmd, "stdout")
+	})
+	registerDbgpCmdHandler("stderr", func(es *engineState, dCmd dbgpCmd) string {
+		return handleStdFd(es, dCmd, "stderr")
+	})
+	registerDbgpCmdHandler("stdin", func(es *engineState, dCmd dbgpCmd) string {
+		return handleStdFd(es, dCmd, "stdin")
+	})
+}
+
+// The rr trace contains every write(2) the PHP process made. Whenever stdout/stderr is enabled by the IDE, we
+// break on write() in gdb and pass on whatever is being written as a <stream> packet.
+//
+// Nothing is actually written to a real stdout/stderr during a replay so copy (-c 1) and redirect (-c 2) are treated
+// the same way. stdin can never be supported as the replay can only read what was read during the recording
+func handleStdFd(es *engineState, dCmd dbgpCmd, fdName string) string {
+	if fdName == "stdin" {
+		return fmt.Sprintf(gStdFdXMLResponseFormat, dCmd.seqNum, fdName, 0)
+	}
+
+	c, ok := dCmd.options["c"]
+	if !ok {
+		return fmt.Sprintf(gErrorXMLResponseFormat, fdName, dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Please provide option -c")
+	}
+
+	mode, err := strconv.Atoi(c)
+	if err != nil || mode < 0 || mode > 2 {
+		return fmt.Sprintf(gErrorXMLResponseFormat, fdName, dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Option -c should be 0, 1 or 2")
+	}
+
+	es.stdFdModes[fdName] = mode
+	if !updateStdFdBreakpoint(es) {
+		return fmt.Sprintf(gStdFdXMLResponseFormat, dCmd.seqNum, fdName, 0)
+	}
+
+	return fmt.Sprintf(gStdFdXMLResponseFormat, dCmd.seqNum, fdName, 1)
+}
+
+// (Re)creates the gdb breakpoint on write(2) depending on which of stdout/stderr are enabled.
+// The arguments to write() are read from the registers they are passed in on x86-64. So stdout/stderr are only
+// supported for x86-64 PHP executables. See captureStdFdWrite()
+func updateStdFdBreakpoint(es *engineState) bool {
+	if es.stdFdBpID != "" {
+		sendGdbCommand(es.gdbSession, "break-delete", es.stdFdBpID)
+		es.stdFdBpID = ""
+	}
+
+	var conditions []string
+	if es.stdFdModes["stdout"] > 0 {
+		conditions = append(conditions, "$rdi == 1")
+	}
+
+	if es.stdFdModes["stderr"] > 0 {
+		conditions = append(conditions, "$rdi == 2")
+	}
+
+	if len(conditions) == 0 {
+		return true
+	}
+
+	if !strings.Contains(xGdbConsoleCmd(es, "show architecture"), "x86-64") {
+		color.Red("dontbug: stdout/stderr can only be sent to the IDE for x86-64 PHP executables")
+		return false
+	}
+
+	breakInsertAr := []string{
+		"-f",
+		"-c",
+		fmt.Sprintf("\"%v\"", strings.Join(conditions, " || ")),
+		"write",
+	}
+
+	result := sendGdbCommand(es.gdbSession, "break-insert", breakInsertAr...)
+	if result["class"] != "done" {
+		color.Red("dontbug: Could not set a breakpoint on write() in gdb backend. stdout/stderr will not be sent to the IDE")
+		return false
+	}
+
+	payload := result["payload"].(map[string]interface{})
+	bkpt := payload["bkpt"].(map[string]interface{})
+	es.stdFdBpID = bkpt["number"].(string)
+	return true
+}
+
+// We're at the beginning of write(2). Read the buffer about to be written (or un-written, if in reverse)
+func captureStdFdWrite(es *engineState, reverse bool) {
+	fd := xSlashDgdb(es.gdbSession, "$rdi")
+	count := xSlashDgdb(es.gdbSession, "$rdx")
+
+	fdName := "stdout"
+	if fd == 2 {
+		fdName = "stderr"
+	}
+
+	if count <= 0 || es.stdFdModes[fdName] == 0 {
+		return
+	}
+
+	result := sendGdbCommand(es.gdbSession, "data-read-memory-bytes", "$rsi", strconv.Itoa(count))
+	if result["class"] != "done" {
+		color.Red("dontbug: Could not read %v bytes written to %v", count, fdName)
+		return
+	}
+
+	payload := result["payload"].(map[string]interface{})
+	memory := payload["memory"].([]interface{})
+
+	var buf bytes.Buffer
+	for _, block := range memory {
+		contents := block.(map[string]interface{})["contents"].(string)
+		data, err := hex.DecodeString(contents)
+		panicIf(err)
+		buf.Write(data)
+	}
+
+	addPendingStream(es, engineStreamChunk{fdName, buf.Bytes(), reverse})
+}
+
+// Consecutive writes to the same fd in the same direction are coalesced. Running in reverse, we come across the
+// writes last to first. Such writes are put in front of the other writes of the reverse run so that the output
+// is always in the order it was written in
+func addPendingStream(es *engineState, chunk engineStreamChunk) {
+	if !chunk.reverse {
+		last := len(es.pendingStreams) - 1
+		if last >= 0 && es.pendingStreams[last].fdName == chunk.fdName && !es.pendingStreams[last].reverse {
+			es.pendingStreams[last].data = append(es.pendingStreams[last].data, chunk.data...)
+			return
+		}
+
+		es.pendingStreams = append(es.pendingStreams, chunk)
+		return
+	}
+
+	// Where the current reverse run starts
+	first := len(es.pendingStreams)
+	for first > 0 && es.pendingStreams[first-1].reverse {
+		first--
+	}
+
+	if first < len(es.pendingStreams) && es.pendingStreams[first].fdName == chunk.fdName {
+		es.pendingStreams[first].data = append(chunk.data, es.pendingStreams[first].data...)
+		return
+	}
+
+	es.pendingStreams = append(es.pendingStreams, engineStreamChunk{})
+	copy(es.pendingStreams[first+1:], es.pendingStreams[first:])
+	es.pendingStreams[first] = chunk
+}
+
+// Send the stdout/stderr output produced since the last time we stopped
+// Should be called before the response to the command that caused the output is sent
+func sendPendingStreams(es *engineState) {
+	for _, chunk := range es.pendingStreams {
+		direction := "forward"
+		if chunk.reverse {
+			// The output is being "un-written" as we are now before the point it was written
+			direction = "reverse"
+		}
+
+		payload := fmt.Sprintf(gStreamXMLFormat, dontbugXMLNamespace, chunk.fdName, direction, base64.StdEncoding.EncodeToString(chunk.data))
+		sendToIde(es, payload)
+	}
+
+	es.pendingStreams = nil
+}
@@ -0,0 +1,48 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddPendingStream(t *testing.T) {
+	// The trace wrote: stdout "a", stdout "b", stderr "c", stdout "d"
+	// Running forward we see them in that order. Running in reverse we see them last to first
+	forward := &engineState{}
+	for _, chunk := range []engineStreamChunk{{"stdout", []byte("a"), false}, {"stdout", []byte("b"), false},
+		{"stderr", []byte("c"), false}, {"stdout", []byte("d"), false}} {
+		addPendingStream(forward, chunk)
+	}
+
+	reverse := &engineState{}
+	for _, chunk := range []engineStreamChunk{{"stdout", []byte("d"), true}, {"stderr", []byte("c"), true},
+		{"stdout", []byte("b"), true}, {"stdout", []byte("a"), true}} {
+		addPendingStream(reverse, chunk)
+	}
+
+	for _, es := range []*engineState{forward, reverse} {
+		var got []string
+		for _, chunk := range es.pendingStreams {
+			got = append(got, chunk.fdName+":"+string(chunk.data))
+		}
+
+		expected := []string{"stdout:ab", "stderr:c", "stdout:d"}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected %v, got %v", expected, got)
+		}
+	}
+}
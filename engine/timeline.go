@@ -0,0 +1,152 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	"strconv"
+	"strings"
+)
+
+// Where we are in the rr trace. An rr event (a system call, signal etc.) can be gone to directly via
+// `run <event>`. ticks are much finer grained and identify a PHP statement uniquely. See currentRRTicks()
+type rrPosition struct {
+	event int64
+	ticks int64
+}
+
+func (p rrPosition) String() string {
+	return fmt.Sprintf("event:%v tick:%v", p.event, p.ticks)
+}
+
+func init() {
+	registerDbgpCmdHandler("dontbug_seek", handleDontbugSeek)
+}
+
+// Notes down the rr position of the stop we have just settled on and shows it in the dontbug prompt
+// es.rrPosition goes with the engine. See acquireEngine()
+func recordRRPosition(es *engineState) {
+	es.rrPosition = rrPosition{currentRREvent(es), currentRRTicks(es)}
+
+	if es.prompt != nil {
+		es.prompt.SetPrompt(promptString(es))
+		es.prompt.Refresh()
+	}
+}
+
+func promptString(es *engineState) string {
+	if es.rrPosition.event == 0 {
+		return "(dontbug) "
+	}
+
+	return fmt.Sprintf("(dontbug %v) ", es.rrPosition)
+}
+
+// dontbug_seek -e <event> or dontbug_seek -t <ticks>
+// Goes to the rr event or tick and then on to the nearest PHP statement (forwards)
+func handleDontbugSeek(es *engineState, dCmd dbgpCmd) string {
+	event, eventOk := dCmd.options["e"]
+	ticks, ticksOk := dCmd.options["t"]
+
+	var err error
+	if eventOk {
+		err = seekToRREvent(es, event)
+	} else if ticksOk {
+		err = seekToRRTicks(es, ticks)
+	} else {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "dontbug_seek", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Please provide either the rr event option -e or the rr ticks option -t")
+	}
+
+	if err != nil {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "dontbug_seek", dCmd.seqNum, dbgpErrorCodeInvalidOptions, xmlAttrEscape(err.Error()))
+	}
+
+	return phpBreakResponse(es, "dontbug_seek", dCmd.seqNum)
+}
+
+func seekToRREvent(es *engineState, eventStr string) error {
+	event, err := strconv.ParseInt(strings.TrimSpace(eventStr), 10, 64)
+	if err != nil || event < 1 {
+		return errors.New("Please provide a valid rr event number. Got: " + eventStr)
+	}
+
+	if !gotoRREvent(es, event) {
+		return fmt.Errorf("Could not go to rr event %v", event)
+	}
+
+	es.status = statusBreak
+	return nil
+}
+
+func seekToRRTicks(es *engineState, ticksStr string) error {
+	ticks, err := strconv.ParseInt(strings.TrimSpace(ticksStr), 10, 64)
+	if err != nil || ticks < 0 {
+		return errors.New("Please provide a valid rr tick count. Got: " + ticksStr)
+	}
+
+	result := sendGdbCommand(es.gdbSession, "interpreter-exec", "console", fmt.Sprintf("\"seek-ticks %v\"", ticks))
+	if result["class"] == "error" {
+		return fmt.Errorf("Could not go to rr tick %v. Your version of rr may not support seeking to a tick. Try an rr event instead", ticks)
+	}
+
+	// rr has moved to the tick without gdb having stopped anywhere. Settle on the nearest PHP statement
+	settleOnPhpStatement(es)
+	es.status = statusBreak
+	return nil
+}
+
+// Goes forward to the next PHP statement or backward to the previous one if there are none ahead
+func settleOnPhpStatement(es *engineState) {
+	id, _ := gotoMasterBpLocationWithNoPhpBpts(es, false)
+	if id == stopIDTraceEnd {
+		// There are no PHP statements after this point
+		gotoMasterBpLocationWithNoPhpBpts(es, true)
+	}
+}
+
+// event <number> or tick <number> on the dontbug prompt
+func handleSeekPromptCmd(es *engineState, seekEvent bool, arg string) {
+	if strings.TrimSpace(arg) == "" {
+		runFromPrompt(es, false, func() {
+			color.Green("dontbug: At %v", es.rrPosition)
+		})
+		return
+	}
+
+	runFromPrompt(es, true, func() {
+		var err error
+		if seekEvent {
+			err = seekToRREvent(es, arg)
+		} else {
+			err = seekToRRTicks(es, arg)
+		}
+
+		if err != nil {
+			color.Red("dontbug: %v", err)
+			return
+		}
+
+		notifyIfRequestChanged(es)
+		resolvePendingWatchBreakpoints(es)
+		recordRRPosition(es)
+		updateSessionFromEngineState(es)
+
+		filename, phpLineno := phpFilenameAndLineno(es)
+		color.Green("dontbug: Now at %v:%v (%v)", filename, phpLineno, es.rrPosition)
+		color.Yellow("dontbug: Your IDE will show the new position after your next step or run")
+	})
+}
@@ -0,0 +1,167 @@
+// Copyright © 2016 Sidharth Kshatriya
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+)
+
+// -t watch -- base64(expression) e.g. $order->total
+// A watch breakpoint is a gdb (hardware) watchpoint on the zval of the PHP variable. rr can run to a watchpoint
+// in either direction so this answers "where was $order->total last modified?" when running in reverse.
+//
+// The zval lives in the PHP stack frame (or an object, array etc.) where the variable was resolved. Once that frame
+// is gone, the memory will be reused for something else. So we resolve the variable again (in the frame that is
+// current at that point) or wait for a PHP statement where the variable can be resolved again.
+func handleBreakpointSetWatchBreakpoint(es *engineState, dCmd dbgpCmd) string {
+	expression := dCmd.data
+	if expression == "" {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Please provide an expression for the watch breakpoint")
+	}
+
+	if es.status == statusStopping {
+		return traceEndNotAvailableResponse(dCmd)
+	}
+
+	status, _, temporary, err := parseBreakpointStatusAndTemporary(dCmd)
+	if err != nil {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, err.Error())
+	}
+
+	// Hits are counted over the whole trace but the variable is only known in the frame it was resolved in
+	// See countBreakpointHitsInTrace()
+	hitValue, hitCondition, _, err := parseHitCondition(dCmd)
+	if err != nil {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, err.Error())
+	}
+
+	if hitValue > 0 {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, dbgpErrorCodeInvalidOptions, "Hit conditions are not supported for watch breakpoints")
+	}
+
+	response, ok := matchingBreakpointSetResponse(es, dCmd, gBreakpointSetXMLResponseFormat, &engineBreakPoint{
+		bpType:       breakpointTypeWatch,
+		expression:   expression,
+		state:        engineBreakpointState(status),
+		temporary:    temporary,
+		hitValue:     hitValue,
+		hitCondition: hitCondition,
+	})
+	if ok {
+		return response
+	}
+
+	bp := &engineBreakPoint{
+		bpType:       breakpointTypeWatch,
+		expression:   expression,
+		state:        engineBreakpointState(status),
+		temporary:    temporary,
+		hitValue:     hitValue,
+		hitCondition: hitCondition,
+	}
+
+	if !resolveWatchBreakpoint(es, bp) {
+		return fmt.Sprintf(gErrorXMLResponseFormat, "breakpoint_set", dCmd.seqNum, breakpointErrorCodeCouldNotSet, xmlAttrEscape("Could not find "+expression+" at the current PHP statement"))
+	}
+
+	// Later gdb watchpoints (after the variable is resolved again) are mapped back to this id
+	// See gdbIDForPhpBreakpointID()
+	bp.id = nextPhpBreakpointID(es)
+	es.breakpoints[bp.id] = bp
+	return fmt.Sprintf(gBreakpointSetXMLResponseFormat, dCmd.seqNum, status, bp.id)
+}
+
+// Finds the zval of the watch expression in the current PHP stack frame and sets a gdb watchpoint on it
+// Returns false if the expression does not resolve to anything at the moment
+func resolveWatchBreakpoint(es *engineState, bp *engineBreakPoint) bool {
+	var address, frame, function string
+	withAllGdbBreakpointsDisabled(es, func() {
+		address = xGdbCmdValue(es.gdbSession, fmt.Sprintf("(long) dontbug_php_symbol_address(\"%v\")", gdbCStringEscape(bp.expression)))
+		frame = xGdbCmdValue(es.gdbSession, "(long) dontbug_user_frame()")
+		function = xGdbCmdValue(es.gdbSession, "(long) dontbug_user_frame()->func")
+	})
+
+	if address == "0" || frame == "0" {
+		return false
+	}
+
+	// The value and the type info of the zval. The string/array etc. the zval points to is not watched, so changes
+	// to those made in place (e.g. $a[] = 1) go unnoticed. See the README
+	result := sendGdbCommand(es.gdbSession, "break-watch", fmt.Sprintf("\"*(long (*)[2]) %v\"", address))
+	if result["class"] != "done" {
+		color.Red("dontbug: Could not set watchpoint in gdb backend for %v", bp.expression)
+		return false
+	}
+
+	payload := result["payload"].(map[string]interface{})
+	wpt := payload["wpt"].(map[string]interface{})
+	bp.gdbID = wpt["number"].(string)
+	bp.watchFrame = frame
+	bp.watchFunction = function
+
+	if bp.state == breakpointStateDisabled {
+		sendGdbCommand(es.gdbSession, "break-disable", bp.gdbID)
+	}
+
+	return true
+}
+
+// The gdb watchpoint is removed but the watch breakpoint remains so that it can be resolved again later
+func unresolveWatchBreakpoint(es *engineState, bp *engineBreakPoint) {
+	if bp.gdbID != "" {
+		sendGdbCommand(es.gdbSession, "break-delete", bp.gdbID)
+		bp.gdbID = ""
+	}
+}
+
+// Is the PHP stack frame the watch breakpoint was resolved in still around?
+func isWatchFrameAlive(es *engineState, bp *engineBreakPoint) bool {
+	alive := xSlashDgdb(es.gdbSession, fmt.Sprintf("dontbug_is_frame_alive((void *) %v, (void *) %v)", bp.watchFrame, bp.watchFunction))
+	return alive == 1
+}
+
+// A hit on a watch breakpoint whose frame is gone is just the memory being reused. The variable is resolved
+// again in the current frame, if possible. Returns true if the hit should be skipped for this reason
+func isStaleWatchBreakpointHit(es *engineState, bp *engineBreakPoint) bool {
+	if bp.bpType != breakpointTypeWatch || isWatchFrameAlive(es, bp) {
+		return false
+	}
+
+	unresolveWatchBreakpoint(es, bp)
+	resolveWatchBreakpoint(es, bp)
+	return true
+}
+
+// Watch breakpoints that went out of scope are resolved again whenever we settle on a PHP statement
+func resolvePendingWatchBreakpoints(es *engineState) {
+	for _, bp := range es.breakpoints {
+		if bp.bpType != breakpointTypeWatch {
+			continue
+		}
+
+		if bp.gdbID != "" && !isWatchFrameAlive(es, bp) {
+			unresolveWatchBreakpoint(es, bp)
+		}
+
+		if bp.gdbID == "" {
+			resolveWatchBreakpoint(es, bp)
+		}
+	}
+}
+
+func atWatchBreakpoint(es *engineState) bool {
+	return es.status == statusBreak && es.lastHitBreakpoint != nil && es.lastHitBreakpoint.bpType == breakpointTypeWatch
+}
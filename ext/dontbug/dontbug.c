@@ -33,6 +33,9 @@
 
 extern ZEND_DECLARE_MODULE_GLOBALS(xdebug)
 
+// Incremented at the start of every (web) request. Read by the dontbug engine from gdb
+unsigned long dontbug_request_num = 0;
+
 PHP_MINIT_FUNCTION(dontbug) {
     return SUCCESS;
 }
@@ -45,10 +48,13 @@ PHP_RINIT_FUNCTION(dontbug) {
 #if defined(COMPILE_DL_DONTBUG) && defined(ZTS)
     ZEND_TSRMLS_CACHE_UPDATE();
 #endif
+    dontbug_request_num++;
+    dontbug_request_startup();
     return SUCCESS;
 }
 
 PHP_RSHUTDOWN_FUNCTION(dontbug) {
+    dontbug_request_shutdown();
     return SUCCESS;
 }
 
@@ -77,6 +83,9 @@ zend_module_entry dontbug_module_entry = {
 void dontbug_statement_handler(zend_op_array *op_array) {
     zend_execute_data* execute_data = EG(current_execute_data);
 
+    // Whoever else sets zend_error_cb (e.g. Xdebug at the start of a request) we need to be in front of them
+    dontbug_ensure_error_cb();
+
     if (!execute_data) {
         return;
     }
@@ -93,6 +102,12 @@ void dontbug_statement_handler(zend_op_array *op_array) {
         // level related breakpoints
         dontbug_level_location(level, filename, lineno);
 
+        // function/method call breakpoints
+        if (op_array->function_name && dontbug_is_function_entry(execute_data)) {
+            zend_ulong class_hash = op_array->scope ? dontbug_lowercase_hash(op_array->scope->name) : 0;
+            dontbug_function_entry_location(dontbug_lowercase_hash(op_array->function_name), class_hash, filename, lineno, level);
+        }
+
         // Pass the zend_string and not the cstring
         dontbug_break_location(op_array->filename, execute_data, lineno, level);
 
@@ -100,6 +115,38 @@ void dontbug_statement_handler(zend_op_array *op_array) {
     }
 }
 
+// gdb breaks on this function for "call" breakpoints. The hashes are of the lower cased function and class names
+// class_hash is 0 for functions that are not methods. See dontbug_lowercase_hash()
+void dontbug_function_entry_location(zend_ulong function_hash, zend_ulong class_hash, char *filename, int lineno, unsigned long level) {
+    return; // function entry
+}
+
+static void (*dontbug_prev_execute_ex)(zend_execute_data *execute_data) = NULL;
+
+// The frame of the user function that has just been called and has not run a statement yet. NULL if none
+static zend_execute_data *dontbug_entered_frame = NULL;
+
+// zend_execute_ex is run for every call of a user function (Xdebug overrides it too so the VM never skips it)
+// It is also run when a generator resumes, which is not a call
+static void dontbug_execute_ex(zend_execute_data *execute_data) {
+    if (dontbug_is_frame_start(execute_data)) {
+        dontbug_entered_frame = execute_data;
+    }
+
+    dontbug_prev_execute_ex(execute_data);
+}
+
+// Returns 1 only for the first statement run in a frame that has just been called. A loop that jumps back to
+// the first statement of the function is not a call
+int dontbug_is_function_entry(zend_execute_data *execute_data) {
+    if (execute_data != dontbug_entered_frame) {
+        return 0;
+    }
+
+    dontbug_entered_frame = NULL;
+    return 1;
+}
+
 static char* dontbug_xml_cstringify(xdebug_xml_node *node) {
     xdebug_str *node_xstringified;
     xdebug_str_ptr_init(node_xstringified);
@@ -112,6 +159,227 @@ static char* dontbug_xml_cstringify(xdebug_xml_node *node) {
     return node_xstringified->d;
 }
 
+// The value being returned while we're in dontbug_function_return_location(). NULL otherwise
+static zval *dontbug_return_value = NULL;
+
+// The previous user opcode handlers (if any) for ZEND_RETURN etc. so that we can chain them
+static user_opcode_handler_t dontbug_prev_return_handlers[256];
+
+// gdb breaks on this function for "return" breakpoints. Parameters are the same as dontbug_function_entry_location()
+void dontbug_function_return_location(zend_ulong function_hash, zend_ulong class_hash, char *filename, int lineno, unsigned long level) {
+    return; // function return
+}
+
+static int dontbug_return_handler(zend_execute_data *execute_data) {
+    const zend_op *opline = execute_data->opline;
+    zend_op_array *op_array = &execute_data->func->op_array;
+
+    if (ZEND_USER_CODE(execute_data->func->type) && op_array->function_name) {
+        zend_free_op free_op;
+        zend_ulong class_hash = op_array->scope ? dontbug_lowercase_hash(op_array->scope->name) : 0;
+
+        // BP_VAR_IS so that an undefined variable does not result in an (extra) notice
+        dontbug_return_value = zend_get_zval_ptr(opline->op1_type, &opline->op1, execute_data, &free_op, BP_VAR_IS);
+        dontbug_function_return_location(dontbug_lowercase_hash(op_array->function_name), class_hash,
+                ZSTR_VAL(op_array->filename), opline->lineno, XG(level));
+        dontbug_return_value = NULL;
+    }
+
+    if (dontbug_prev_return_handlers[opline->opcode]) {
+        return dontbug_prev_return_handlers[opline->opcode](execute_data);
+    }
+
+    return ZEND_USER_OPCODE_DISPATCH;
+}
+
+static void dontbug_set_return_handler(zend_uchar opcode) {
+    dontbug_prev_return_handlers[opcode] = zend_get_user_opcode_handler(opcode);
+    zend_set_user_opcode_handler(opcode, dontbug_return_handler);
+}
+
+// The previous zend_throw_exception_hook (if any) so that we can chain it
+static void (*dontbug_prev_throw_exception_hook)(zval *exception) = NULL;
+
+// gdb breaks on this function for "exception" breakpoints. It is called once for the class of the exception
+// (depth 0) and then once for each of its ancestor classes and interfaces (depth 1, 2...) so that
+// a breakpoint on a class also matches its subclasses
+void dontbug_exception_location(zend_ulong class_hash, int depth, char *exception_name, char *filename, int lineno, unsigned long level) {
+    return; // exception
+}
+
+static void dontbug_throw_exception_hook(zval *exception) {
+    zend_execute_data *execute_data = EG(current_execute_data);
+
+    // Exceptions thrown by internal functions are reported at the user code that called them
+    while (execute_data && (!execute_data->func || !ZEND_USER_CODE(execute_data->func->type))) {
+        execute_data = execute_data->prev_execute_data;
+    }
+
+    if (exception && Z_TYPE_P(exception) == IS_OBJECT && execute_data) {
+        zend_class_entry *exception_ce = Z_OBJCE_P(exception);
+        zend_class_entry *ce;
+        char *exception_name = ZSTR_VAL(exception_ce->name);
+        char *filename = ZSTR_VAL(execute_data->func->op_array.filename);
+        int lineno = execute_data->opline->lineno;
+        unsigned long level = XG(level);
+        int depth = 0;
+        uint32_t i;
+
+        for (ce = exception_ce; ce; ce = ce->parent) {
+            dontbug_exception_location(dontbug_lowercase_hash(ce->name), depth++, exception_name, filename, lineno, level);
+        }
+
+        // The class of the exception has all the interfaces its ancestors implement too
+        for (i = 0; i < exception_ce->num_interfaces; i++) {
+            dontbug_exception_location(dontbug_lowercase_hash(exception_ce->interfaces[i]->name), depth++, exception_name, filename, lineno, level);
+        }
+    }
+
+    if (dontbug_prev_throw_exception_hook) {
+        dontbug_prev_throw_exception_hook(exception);
+    }
+}
+
+// The previous zend_error_cb so that we can chain it (Xdebug also installs its own)
+static void (*dontbug_prev_error_cb)(int type, const char *error_filename, const uint error_lineno, const char *format, va_list args) = NULL;
+
+// gdb breaks on this function for breakpoints on PHP errors, warnings, notices etc.
+// type is the E_* constant e.g. E_WARNING and message is the formatted error message
+void dontbug_error_location(int type, char *message, char *filename, int lineno, unsigned long level) {
+    return; // error
+}
+
+void dontbug_error_cb(int type, const char *error_filename, const uint error_lineno, const char *format, va_list args) {
+    char *message = NULL;
+    va_list args_copy;
+
+    // args can only be used once and the original error callback needs them too
+    va_copy(args_copy, args);
+    vspprintf(&message, 0, format, args_copy);
+    va_end(args_copy);
+
+    dontbug_error_location(type, message, error_filename ? (char *) error_filename : "", error_lineno, XG(level));
+    efree(message);
+
+    dontbug_prev_error_cb(type, error_filename, error_lineno, format, args);
+}
+
+// Xdebug sets its own zend_error_cb at the start of every request (and does not chain the previous one). Whether
+// its RINIT runs before or after ours depends on the order the extensions were loaded in. So instead of setting
+// ours at a particular point, we check on every PHP statement that ours is still the one in front
+void dontbug_ensure_error_cb() {
+    if (zend_error_cb != dontbug_error_cb) {
+        dontbug_prev_error_cb = zend_error_cb;
+        zend_error_cb = dontbug_error_cb;
+    }
+}
+
+// Only if ours is still the one in front. If someone has put theirs back already, we leave it alone
+void dontbug_restore_error_cb() {
+    if (zend_error_cb == dontbug_error_cb) {
+        zend_error_cb = dontbug_prev_error_cb;
+    }
+}
+
+// Marks where each (web) request starts so that gdb can break on it e.g. to go to a particular request
+// request_num is the value of dontbug_request_num for the request
+void dontbug_request_start_location(unsigned long request_num, char *method, char *uri) {
+    return; // request start
+}
+
+// The method (e.g. GET) and URI of the current request. Empty strings for the PHP CLI
+char* dontbug_request_method() {
+    return SG(request_info).request_method ? (char *) SG(request_info).request_method : "";
+}
+
+char* dontbug_request_uri() {
+    return SG(request_info).request_uri ? SG(request_info).request_uri : "";
+}
+
+// Called from PHP_RINIT_FUNCTION
+void dontbug_request_startup() {
+    dontbug_request_start_location(dontbug_request_num, dontbug_request_method(), dontbug_request_uri());
+}
+
+// Called from PHP_RSHUTDOWN_FUNCTION
+void dontbug_request_shutdown() {
+    dontbug_restore_error_cb();
+}
+
+// Returns the nearest frame that is running user (PHP) code or NULL if there is none
+zend_execute_data* dontbug_user_frame() {
+    zend_execute_data *execute_data = EG(current_execute_data);
+
+    while (execute_data && (!execute_data->func || !ZEND_USER_CODE(execute_data->func->type))) {
+        execute_data = execute_data->prev_execute_data;
+    }
+
+    return execute_data;
+}
+
+// The following are called from GDB when we're stopped somewhere in the middle of the PHP interpreter
+// e.g. due to a watchpoint. They describe the PHP statement currently being executed
+char* dontbug_current_filename() {
+    zend_execute_data *execute_data = dontbug_user_frame();
+    return execute_data ? ZSTR_VAL(execute_data->func->op_array.filename) : "";
+}
+
+int dontbug_current_lineno() {
+    zend_execute_data *execute_data = dontbug_user_frame();
+    return execute_data ? execute_data->opline->lineno : 0;
+}
+
+unsigned long dontbug_current_level() {
+    return XG(level);
+}
+
+// Returns 1 if frame (running func) is still on the PHP stack
+int dontbug_is_frame_alive(zend_execute_data *frame, zend_function *func) {
+    zend_execute_data *execute_data = EG(current_execute_data);
+
+    for (; execute_data; execute_data = execute_data->prev_execute_data) {
+        if (execute_data == frame && execute_data->func == func) {
+            return 1;
+        }
+    }
+
+    return 0;
+}
+
+// Note: this function is always called from GDB in a diversion session
+// Returns the address of the zval for a PHP variable e.g. "$order->total" in the current frame or NULL if there is no such variable
+zval* dontbug_php_symbol_address(char *name) {
+    zval *symbol;
+
+    XG(active_execute_data) = dontbug_user_frame();
+    if (!XG(active_execute_data)) {
+        return NULL;
+    }
+
+    // We don't worry about side effects as we're in a diversion session
+    XG(active_symbol_table) = zend_rebuild_symbol_table();
+    symbol = xdebug_get_php_symbol(name);
+    if (!symbol) {
+        return NULL;
+    }
+
+    // Watch the value a reference points to and not the reference itself
+    ZVAL_DEREF(symbol);
+    return symbol;
+}
+
+// Note: this function is always called from GDB (in a diversion session) when stopped in dontbug_function_return_location()
+// Returns the xml for the return value as a pseudo-variable called name or an empty string if there is no return value
+char* dontbug_return_value_xml(char *name) {
+    if (!dontbug_return_value) {
+        return "";
+    }
+
+    xdebug_var_export_options *options = (xdebug_var_export_options*) XG(context).options;
+    xdebug_xml_node *node = xdebug_get_zval_value_xml_node(name, dontbug_return_value, options);
+    return dontbug_xml_cstringify(node);
+}
+
 // Note: this function is always called from GDB
 // - This is also why this function is extern
 // - Additionally, this function is never called by any other function in this Zend extension
@@ -163,6 +431,16 @@ ZEND_DLEXPORT int dontbug_zend_startup(zend_extension *extension) {
         fprintf(stderr, "dontbug zend extension: Xdebug entrypoint not found\n");
     }
 
+    dontbug_set_return_handler(ZEND_RETURN);
+    dontbug_set_return_handler(ZEND_RETURN_BY_REF);
+    dontbug_set_return_handler(ZEND_GENERATOR_RETURN);
+
+    dontbug_prev_throw_exception_hook = zend_throw_exception_hook;
+    zend_throw_exception_hook = dontbug_throw_exception_hook;
+
+    dontbug_prev_execute_ex = zend_execute_ex;
+    zend_execute_ex = dontbug_execute_ex;
+
     // It is important that this message is last vis-a-vis above messages; ordering matters
     // This specific string is searched for by the dontbug engine - DONT CHANGE IT!
     fprintf(stderr, "dontbug zend extension: dontbug.so successfully loaded by PHP\n");
@@ -32,6 +32,9 @@ extern zend_module_entry dontbug_module_entry;
 #include "TSRM.h"
 #endif
 
+#include "zend_exceptions.h"
+#include "SAPI.h"
+
 #define DONTBUG_G(v) ZEND_MODULE_GLOBALS_ACCESSOR(dontbug, v)
 
 #if defined(ZTS) && defined(COMPILE_DL_DONTBUG)
@@ -42,7 +45,55 @@ ZEND_TSRMLS_CACHE_EXTERN()
 
 void dontbug_break_location(zend_string* filename, zend_execute_data *execute_data, int lineno, unsigned long level);
 void dontbug_level_location(unsigned long level, char* filename, int lineno);
+void dontbug_function_entry_location(zend_ulong function_hash, zend_ulong class_hash, char *filename, int lineno, unsigned long level);
+void dontbug_function_return_location(zend_ulong function_hash, zend_ulong class_hash, char *filename, int lineno, unsigned long level);
+void dontbug_exception_location(zend_ulong class_hash, int depth, char *exception_name, char *filename, int lineno, unsigned long level);
+void dontbug_error_location(int type, char *message, char *filename, int lineno, unsigned long level);
+void dontbug_error_cb(int type, const char *error_filename, const uint error_lineno, const char *format, va_list args);
+void dontbug_ensure_error_cb();
+void dontbug_restore_error_cb();
+void dontbug_request_start_location(unsigned long request_num, char *method, char *uri);
+void dontbug_request_startup();
+void dontbug_request_shutdown();
+
+// Same as zend_inline_hash_func() applied on a lower cased copy of str (PHP function and class names are case insensitive)
+static inline zend_ulong dontbug_lowercase_hash(zend_string *str) {
+    zend_ulong hash = Z_UL(5381);
+    size_t i;
+
+    for (i = 0; i < ZSTR_LEN(str); i++) {
+        hash = ((hash << 5) + hash) + (unsigned char) zend_tolower_ascii(ZSTR_VAL(str)[i]);
+    }
+
+    return hash | Z_UL(0x8000000000000000);
+}
+
+// Returns 1 if execute_data has not run any statement of its function yet i.e. it has just been called rather than
+// being a generator that is resuming. Only the RECV opcodes for the arguments can come before the first statement
+static inline int dontbug_is_frame_start(zend_execute_data *execute_data) {
+    const zend_op *op;
+
+    for (op = execute_data->func->op_array.opcodes; op < execute_data->opline; op++) {
+        if (op->opcode == ZEND_EXT_STMT) {
+            return 0;
+        }
+    }
+
+    return 1;
+}
+
+int dontbug_is_function_entry(zend_execute_data *execute_data);
 
 char* dontbug_xdebug_cmd(char* command);
+char* dontbug_return_value_xml(char *name);
+
+zend_execute_data* dontbug_user_frame();
+char* dontbug_current_filename();
+int dontbug_current_lineno();
+unsigned long dontbug_current_level();
+int dontbug_is_frame_alive(zend_execute_data *frame, zend_function *func);
+zval* dontbug_php_symbol_address(char *name);
+char* dontbug_request_method();
+char* dontbug_request_uri();
 
 #endif